@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"os"
+)
+
+func main() {
+	ns := flag.String("ns", "rsmq", "namespace of the queues to check")
+	repair := flag.Bool("repair", false, "fix the inconsistencies that are found")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), `
+fsck checks queues for orphan message fields, messages without bodies and
+queues missing from QUEUES. Every queue in the namespace is checked when no
+queue names are given.
+
+USAGE: fsck [-ns rsmq] [-repair] [queue ...]`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx := context.Background()
+	url := os.Getenv("REDIS_URL")
+	if len(url) == 0 {
+		url = "redis://localhost:6379"
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		log.Fatalln("parseURL:", err)
+	}
+	mq, err := q.New(ctx, q.Options{
+		Client:    redis.NewClient(opts),
+		NameSpace: ns,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	queues := flag.Args()
+	if len(queues) == 0 {
+		queues, err = mq.ListQueues(ctx)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	inconsistent := false
+	for _, qname := range queues {
+		var report *q.QueueReport
+		if *repair {
+			report, err = mq.RepairQueue(ctx, q.RepairQueueOptions{QName: qname})
+		} else {
+			report, err = mq.CheckQueue(ctx, q.CheckQueueOptions{QName: qname})
+		}
+		if err != nil {
+			log.Fatalln(qname+":", err)
+		}
+		if report.Consistent() {
+			fmt.Println(qname, "ok")
+			continue
+		}
+		inconsistent = inconsistent || !report.Repaired
+		fmt.Println(report)
+	}
+	if inconsistent {
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"github.com/ebuckley/rsmq/q"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 )
 
 func main() {
@@ -17,13 +19,14 @@ func main() {
 	useOS := len(os.Args) > 1 && os.Args[1] == "live"
 	//
 	nr := mux.NewRouter()
+	// one queue is shared by every handler, it holds the redis connection pool
+	queue, err := q.New(context.Background(), q.Options{})
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// handle the index
 	nr.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		queue, err := q.New(req.Context(), q.Options{})
-		if err != nil {
-			http.Error(res, err.Error(), 500)
-		}
 		queues, err := queue.ListQueues(req.Context())
 		if err != nil {
 			http.Error(res, err.Error(), 500)
@@ -52,12 +55,6 @@ func main() {
 			http.Error(w, "Not found", 404)
 			return
 		}
-		queue, err := q.New(r.Context(), q.Options{})
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
 		if r.Method == http.MethodDelete {
 			err := queue.DeleteQueue(r.Context(), q.DeleteQueueRequestOptions{QName: qname})
 			if err != nil {
@@ -97,12 +94,6 @@ func main() {
 			http.Error(w, "Not found", 404)
 			return
 		}
-		queue, err := q.New(r.Context(), q.Options{})
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-
 		if r.Method == http.MethodPost {
 			qUpdate := q.SetAttributesOptions{
 				QName: qname,
@@ -134,8 +125,24 @@ func main() {
 				}
 				qUpdate.Maxsize = &val
 			}
+			if len(r.PostFormValue("MaxMessages")) > 0 {
+				val, err := strconv.ParseInt(r.PostFormValue("MaxMessages"), 10, 64)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				qUpdate.MaxMessages = &val
+			}
+			if len(r.PostFormValue("MaxBytes")) > 0 {
+				val, err := strconv.ParseInt(r.PostFormValue("MaxBytes"), 10, 64)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				qUpdate.MaxBytes = &val
+			}
 
-			_, err = queue.SetQueueAttributes(r.Context(), qUpdate)
+			_, err := queue.SetQueueAttributes(r.Context(), qUpdate)
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 				return
@@ -160,14 +167,64 @@ func main() {
 			Attrs: attrs,
 		})
 	})
+	// chart the throughput of a q
+	nr.HandleFunc("/q/{qname}/throughput", func(w http.ResponseWriter, r *http.Request) {
+		qname := mux.Vars(r)["qname"]
+		var err error
+		hours := 1
+		if len(r.FormValue("hours")) > 0 {
+			hours, err = strconv.Atoi(r.FormValue("hours"))
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		// aim for about 60 bars whatever the period
+		resolution := time.Duration(hours) * time.Minute
+		buckets, err := queue.GetQueueThroughput(r.Context(), q.GetQueueThroughputOptions{
+			QName:      qname,
+			Since:      time.Now().Add(-time.Duration(hours) * time.Hour),
+			Resolution: resolution,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		tpl := mustTemplate(useOS, "templates/ConnectionThroughput.html")
+		tpl.Execute(w, newThroughputChart(qname, hours, buckets))
+	})
+
+	// handle pausing and resuming a q
+	nr.HandleFunc("/q/{qname}/{action:pause|resume}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+		vs := mux.Vars(r)
+		qname := vs["qname"]
+		var err error
+		if vs["action"] == "pause" {
+			err = queue.PauseQueue(r.Context(), q.PauseQueueOptions{QName: qname})
+		} else {
+			err = queue.ResumeQueue(r.Context(), q.ResumeQueueOptions{QName: qname})
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		// redirect back to the q page
+		http.Redirect(w, r, "/q/"+qname, http.StatusFound)
+	})
 	nr.PathPrefix("/").Handler(http.FileServer(getFileSystem(useOS, embededFiles)))
 
 	//addUserRoutes(nr.PathPrefix("/user/").Subrouter())
 	// print out registered routes
 	//printrouter(nr)
 
+	go sweepExpired(queue, time.Minute)
+
 	log.Println("STARTING ON :8989")
-	err := http.ListenAndServe(":8989", nr)
+	err = http.ListenAndServe(":8989", nr)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"fmt"
+	"github.com/ebuckley/rsmq/q"
 	"github.com/gorilla/mux"
 	"html/template"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -37,7 +40,12 @@ func mustTemplate(useOs bool, name string) (tpl *template.Template) {
 	trimI := strings.Index(name, templateDir) + len(templateDir) + 1
 	tpl, err = template.New(name[trimI:]).Funcs(template.FuncMap{
 		"prettyDate": func(dt string) template.HTML {
+			// queues store unix seconds, older versions of this package stored an RFC3339 time
 			parse, err := time.Parse(time.RFC3339, dt)
+			if unix, unixErr := strconv.ParseInt(dt, 10, 64); unixErr == nil {
+				parse, err = time.Unix(unix, 0), nil
+				dt = parse.Format(time.RFC3339)
+			}
 			if err != nil {
 				return template.HTML("Unknown Date (" + dt + ")")
 			}
@@ -53,6 +61,49 @@ func mustTemplate(useOs bool, name string) (tpl *template.Template) {
 	return tpl
 }
 
+type throughputBar struct {
+	X                     int
+	SentY, SentHeight     int
+	ReceivedY, RecvHeight int
+	Title                 string
+}
+
+// ThroughputChart is an svg bar chart of sent and received messages per bucket
+type ThroughputChart struct {
+	Name   string
+	Hours  int
+	Width  int
+	Height int
+	Max    int64
+	Bars   []throughputBar
+}
+
+func newThroughputChart(name string, hours int, buckets []q.ThroughputBucket) ThroughputChart {
+	const barWidth, height = 10, 120
+	chart := ThroughputChart{Name: name, Hours: hours, Width: len(buckets) * barWidth, Height: height, Max: 1}
+	for _, b := range buckets {
+		if b.Sent > chart.Max {
+			chart.Max = b.Sent
+		}
+		if b.Received > chart.Max {
+			chart.Max = b.Received
+		}
+	}
+	for i, b := range buckets {
+		sent := int(b.Sent * height / chart.Max)
+		recv := int(b.Received * height / chart.Max)
+		chart.Bars = append(chart.Bars, throughputBar{
+			X:          i * barWidth,
+			SentY:      height - sent,
+			SentHeight: sent,
+			ReceivedY:  height - recv,
+			RecvHeight: recv,
+			Title:      fmt.Sprintf("%s sent %d received %d deleted %d", b.Start.Format(time.Kitchen), b.Sent, b.Received, b.Deleted),
+		})
+	}
+	return chart
+}
+
 func getFileSystem(useOS bool, embedfs embed.FS) http.FileSystem {
 	if useOS {
 		log.Println("Using live fs:")
@@ -105,3 +156,20 @@ func printrouter(nr *mux.Router) {
 		return nil
 	})
 }
+
+// sweepExpired runs ExpireMessages on every queue each interval, so expired messages on queues nobody receives from are removed
+func sweepExpired(queue *q.RedisSMQ, interval time.Duration) {
+	ctx := context.Background()
+	for range time.Tick(interval) {
+		qnames, err := queue.ListQueues(ctx)
+		if err != nil {
+			log.Println("sweep:", err)
+			continue
+		}
+		for _, qname := range qnames {
+			if _, err := queue.ExpireMessages(ctx, q.ExpireMessagesOptions{QName: qname}); err != nil {
+				log.Printf("sweep %s: %s", qname, err)
+			}
+		}
+	}
+}
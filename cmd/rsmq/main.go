@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// command is a subcommand of rsmq, run returns the value printed as JSON or nil to print nothing
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error)
+}
+
+var commands = []command{
+	{"create", "create [-vt seconds] [-delay seconds] [-maxsize bytes] <queue>", create},
+	{"list", "list", list},
+	{"attrs", "attrs <queue>", attrs},
+	{"set-attrs", "set-attrs [-vt seconds] [-delay seconds] [-maxsize bytes] [-retention seconds] [-dlq queue] [-maxrecvrate n] [-maxmsgs n] [-maxbytes bytes] <queue>", setAttrs},
+	{"send", "send [-delay seconds] [-ttl seconds] <queue> [message | -]", send},
+	{"receive", "receive [-vt seconds] <queue>", receive},
+	{"pop", "pop <queue>", pop},
+	{"delete-msg", "delete-msg <queue> <id>", deleteMsg},
+	{"change-vis", "change-vis <queue> <id> <vt seconds>", changeVis},
+	{"delete-queue", "delete-queue <queue>", deleteQueue},
+	{"purge", "purge <queue>", purge},
+	{"expire", "expire <queue>", expire},
+	{"watch", "watch [-interval duration] [-n lines] <queue>", watch},
+	{"tail", "tail [-interval duration] [-all] <queue>", tail},
+	{"upgrade", "upgrade", upgrade},
+}
+
+func main() {
+	ns := flag.String("ns", "rsmq", "namespace of the queues")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), `
+rsmq manages the queues in REDIS_URL, which defaults to redis://localhost:6379.
+Results are printed as JSON, a receive or pop from an empty queue prints null.
+send reads the message from stdin when it is missing or -, one trailing newline is dropped.
+watch prints the depth and send and receive rates of a queue as a JSON line per interval.
+tail prints each message as it becomes visible on a queue without receiving it, until interrupted.
+expire removes the messages past their TTL or the queue retention, which are otherwise only removed when received.
+upgrade converts the queues of older versions, which kept the queue delay in milliseconds, to seconds.
+
+USAGE: rsmq [-ns rsmq] <command> [flags] [args]
+
+COMMANDS:`)
+		for _, c := range commands {
+			fmt.Fprintln(flag.CommandLine.Output(), "  "+c.usage)
+		}
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintln(os.Stderr, "rsmq: unknown command", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	url := os.Getenv("REDIS_URL")
+	if len(url) == 0 {
+		url = "redis://localhost:6379"
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		fatal(fmt.Errorf("parseURL: %w", err))
+	}
+	mq, err := q.New(ctx, q.Options{
+		Client:    redis.NewClient(opts),
+		NameSpace: ns,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	defer mq.Close()
+
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "USAGE: rsmq [-ns rsmq]", cmd.usage)
+		fs.PrintDefaults()
+	}
+	out, err := cmd.run(ctx, mq, fs, flag.Args()[1:])
+	if err != nil {
+		fatal(err)
+	}
+	if out != nil {
+		if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "rsmq:", err)
+	os.Exit(1)
+}
+
+// parseArgs parses the flags of a command, and checks it was given between min and max positional arguments
+func parseArgs(fs *flag.FlagSet, args []string, min int, max int) []string {
+	// flag.ExitOnError exits on invalid flags
+	_ = fs.Parse(args)
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+// isSet reports whether the flag was given on the command line
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func create(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	vt := fs.Int("vt", 30, "visibility timeout in seconds")
+	delay := fs.Int("delay", 0, "delay in seconds before new messages are visible")
+	maxsize := fs.Int64("maxsize", 65536, "largest message in bytes")
+	qname := parseArgs(fs, args, 1, 1)[0]
+	err := mq.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qname})
+	if err != nil {
+		return nil, err
+	}
+	if !isSet(fs, "vt") && !isSet(fs, "delay") && !isSet(fs, "maxsize") {
+		return mq.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+	}
+	return mq.SetQueueAttributes(ctx, q.SetAttributesOptions{
+		QName:             qname,
+		VisibilityTimeout: vt,
+		DelayForMessages:  delay,
+		Maxsize:           maxsize,
+	})
+}
+
+func list(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	parseArgs(fs, args, 0, 0)
+	queues, err := mq.ListQueues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if queues == nil {
+		queues = []string{}
+	}
+	return queues, nil
+}
+
+func attrs(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	qname := parseArgs(fs, args, 1, 1)[0]
+	return mq.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+}
+
+func setAttrs(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	vt := fs.Int("vt", 0, "visibility timeout in seconds")
+	delay := fs.Int("delay", 0, "delay in seconds before new messages are visible")
+	maxsize := fs.Int64("maxsize", 0, "largest message in bytes")
+	retention := fs.Int("retention", 0, "seconds messages are kept after they are sent, 0 keeps them forever")
+	dlq := fs.String("dlq", "", "queue expired messages are moved to, empty drops them")
+	maxrecvrate := fs.Int("maxrecvrate", 0, "most receives per second across all consumers, 0 removes the limit")
+	maxmsgs := fs.Int64("maxmsgs", 0, "most messages on the queue, 0 removes the limit")
+	maxbytes := fs.Int64("maxbytes", 0, "most message bytes on the queue, 0 removes the limit")
+	qname := parseArgs(fs, args, 1, 1)[0]
+	// only the attributes given on the command line are changed
+	opts := q.SetAttributesOptions{QName: qname}
+	if isSet(fs, "vt") {
+		opts.VisibilityTimeout = vt
+	}
+	if isSet(fs, "delay") {
+		opts.DelayForMessages = delay
+	}
+	if isSet(fs, "maxsize") {
+		opts.Maxsize = maxsize
+	}
+	if isSet(fs, "retention") {
+		opts.MessageRetentionSeconds = retention
+	}
+	if isSet(fs, "dlq") {
+		opts.DeadLetterQueue = dlq
+	}
+	if isSet(fs, "maxrecvrate") {
+		opts.MaxReceivesPerSecond = maxrecvrate
+	}
+	if isSet(fs, "maxmsgs") {
+		opts.MaxMessages = maxmsgs
+	}
+	if isSet(fs, "maxbytes") {
+		opts.MaxBytes = maxbytes
+	}
+	return mq.SetQueueAttributes(ctx, opts)
+}
+
+func send(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	delay := fs.Int("delay", 0, "seconds until the message is visible, 0 for the queue delay")
+	ttl := fs.Int("ttl", 0, "seconds until the message expires, 0 for the queue retention")
+	args = parseArgs(fs, args, 1, 2)
+	// the delay is resolved against the redis server time, so the local clock does not matter
+	opts := q.SendMessageRequestOptions{QName: args[0], Delay: *delay, TTL: *ttl}
+	if len(args) == 2 && args[1] != "-" {
+		opts.Message = args[1]
+	} else {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read message from stdin: %w", err)
+		}
+		// drop the newline echo adds, so piped messages match the ones given as an argument
+		opts.Message = strings.TrimSuffix(string(b), "\n")
+	}
+	id, err := mq.SendMessage(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"id": id}, nil
+}
+
+func receive(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	vt := fs.Int("vt", 0, "seconds the message is hidden for, instead of the queue visibility timeout")
+	qname := parseArgs(fs, args, 1, 1)[0]
+	opts := q.ReceiveMessageOptions{QName: qname}
+	if isSet(fs, "vt") {
+		opts.VisibilityTimeout = vt
+	}
+	return mq.ReceiveMessage(ctx, opts)
+}
+
+func pop(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	qname := parseArgs(fs, args, 1, 1)[0]
+	return mq.PopMessage(ctx, q.PopMessageOptions{QName: qname})
+}
+
+func deleteMsg(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	args = parseArgs(fs, args, 2, 2)
+	err := mq.DeleteMessage(ctx, q.DeleteMessageRequest{QName: args[0], ID: args[1]})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"deleted": args[1]}, nil
+}
+
+func changeVis(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	args = parseArgs(fs, args, 3, 3)
+	vt, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, errors.New("the visibility timeout must be a number of seconds")
+	}
+	changed, err := mq.ChangeMessageVisibility(ctx, q.ChangeMessageVisibilityOptions{QName: args[0], ID: args[1], VisibilityTimeout: vt})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]bool{"changed": changed}, nil
+}
+
+func deleteQueue(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	qname := parseArgs(fs, args, 1, 1)[0]
+	err := mq.DeleteQueue(ctx, q.DeleteQueueRequestOptions{QName: qname})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"deleted": qname}, nil
+}
+
+func purge(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	qname := parseArgs(fs, args, 1, 1)[0]
+	n, err := mq.PurgeQueue(ctx, q.PurgeQueueOptions{QName: qname})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int64{"purged": n}, nil
+}
+
+func expire(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	qname := parseArgs(fs, args, 1, 1)[0]
+	n, err := mq.ExpireMessages(ctx, q.ExpireMessagesOptions{QName: qname})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int64{"expired": n}, nil
+}
+
+func upgrade(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	parseArgs(fs, args, 0, 0)
+	upgraded, err := mq.UpgradeQueues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if upgraded == nil {
+		upgraded = []string{}
+	}
+	return map[string][]string{"upgraded": upgraded}, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/ebuckley/rsmq/q"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// watchSample is a line printed by watch, the rates are averaged over the interval since the previous line
+type watchSample struct {
+	Time          time.Time `json:"time"`
+	Messages      int64     `json:"msgs"`
+	Hidden        int64     `json:"hiddenmsgs"`
+	SentPerSecond float64   `json:"sentPerSecond"`
+	RecvPerSecond float64   `json:"recvPerSecond"`
+	Paused        bool      `json:"paused,omitempty"`
+}
+
+// watch prints a line of queue attributes every interval until it is interrupted
+func watch(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	interval := fs.Duration("interval", 2*time.Second, "time between lines")
+	count := fs.Int("n", 0, "number of lines to print, 0 runs until interrupted")
+	qname := parseArgs(fs, args, 1, 1)[0]
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	var prev *q.QueueAttributes
+	var prevTime time.Time
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for printed := 0; *count == 0 || printed < *count; printed++ {
+		attrs, err := mq.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		sample := watchSample{Time: now, Messages: attrs.CurrentN, Hidden: attrs.HiddenMessages, Paused: attrs.Paused}
+		if prev != nil {
+			elapsed := now.Sub(prevTime).Seconds()
+			sample.SentPerSecond = float64(attrs.TotalSent-prev.TotalSent) / elapsed
+			sample.RecvPerSecond = float64(attrs.TotalReceived-prev.TotalReceived) / elapsed
+		}
+		if err := enc.Encode(sample); err != nil {
+			return nil, err
+		}
+		prev, prevTime = attrs, now
+		if *count > 0 && printed+1 == *count {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+		}
+	}
+	return nil, nil
+}
+
+// tail prints messages as they become visible on the queue, peeking so they are not received.
+// It reads on from the last message it printed, so messages received within one interval of becoming visible are not seen,
+// and messages which were received before are not printed again when their visibility timeout runs out.
+func tail(ctx context.Context, mq *q.RedisSMQ, fs *flag.FlagSet, args []string) (interface{}, error) {
+	interval := fs.Duration("interval", time.Second, "time between polls of the queue")
+	all := fs.Bool("all", false, "print the messages already on the queue first")
+	qname := parseArgs(fs, args, 1, 1)[0]
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	var after string
+	first := true
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		err := peekAfter(ctx, mq, qname, &after, func(msg *q.Message) error {
+			if msg.RC > 0 || (first && !*all) {
+				return nil
+			}
+			return enc.Encode(msg)
+		})
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		first = false
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// peekAfter calls fn for each visible message ordered after the cursor, and moves the cursor on to the final message read
+func peekAfter(ctx context.Context, mq *q.RedisSMQ, qname string, after *string, fn func(*q.Message) error) error {
+	const limit = 1000
+	for {
+		page, err := mq.PeekMessages(ctx, q.PeekMessagesOptions{QName: qname, After: *after, Limit: limit})
+		if err != nil {
+			return err
+		}
+		for _, msg := range page {
+			if err := fn(msg); err != nil {
+				return err
+			}
+			*after = msg.Cursor
+		}
+		if len(page) < limit {
+			return nil
+		}
+	}
+}
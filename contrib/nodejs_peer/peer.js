@@ -0,0 +1,18 @@
+// peer.js runs a single rsmq call and prints the response as JSON, so the go tests can drive the nodejs implementation
+// usage: node peer.js <method> '<json options>', e.g. node peer.js sendMessage '{"qname":"test","message":"hi"}'
+const RedisSMQ = require("rsmq");
+
+const url = new URL(process.env.REDIS_URL || "redis://127.0.0.1:6379");
+const ns = process.env.RSMQ_NS || "rsmq";
+const [method, options] = process.argv.slice(2);
+
+const rsmq = new RedisSMQ({host: url.hostname, port: Number(url.port || 6379), ns: ns});
+
+rsmq[method](JSON.parse(options || "{}"), function (err, resp) {
+    if (err) {
+        console.error(err.message);
+        process.exit(1);
+    }
+    console.log(JSON.stringify(resp));
+    rsmq.quit();
+});
@@ -0,0 +1,413 @@
+package memq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemorySMQ is an in memory q.Queue with the same semantics as q.RedisSMQ, for tests and single process use.
+// Messages are lost when the process exits.
+type MemorySMQ struct {
+	mu     sync.Mutex
+	clock  func() time.Time
+	queues map[string]*queue
+}
+
+type Options struct {
+	// Clock returns the current time, defaults to time.Now. Tests can use it to step through visibility timeouts
+	Clock func() time.Time
+}
+
+type queue struct {
+	attrs    q.QueueAttributes
+	messages map[string]*message
+	// bucket is the receive rate limit
+	bucket q.TokenBucket
+}
+
+type message struct {
+	id    string
+	body  string
+	score int64
+	rc    int64
+	fr    int64
+	exp   int64
+	meta  map[string]string
+}
+
+var _ q.Queue = (*MemorySMQ)(nil)
+
+// New creates an empty MemorySMQ
+func New(opts Options) *MemorySMQ {
+	clock := opts.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	return &MemorySMQ{clock: clock, queues: map[string]*queue{}}
+}
+
+func (m *MemorySMQ) CreateQueue(ctx context.Context, opts q.CreateQueueRequestOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := strconv.FormatInt(m.clock().Unix(), 10)
+	qu, ok := m.queues[opts.QName]
+	if !ok {
+		qu = &queue{messages: map[string]*message{}}
+		m.queues[opts.QName] = qu
+	}
+	// like RedisSMQ, creating an existing queue resets its attributes but keeps its messages and counters
+	qu.attrs.VisibilityTimeout = 30
+	qu.attrs.DelayForMessages = 0
+	qu.attrs.MaxSizeBytes = 65536
+	qu.attrs.Created = now
+	qu.attrs.Modified = now
+	return nil
+}
+
+func (m *MemorySMQ) ListQueues(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.queues))
+	for name := range m.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemorySMQ) DeleteQueue(ctx context.Context, options q.DeleteQueueRequestOptions) error {
+	if len(options.QName) == 0 {
+		return errors.New("QName is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.queues, options.QName)
+	return nil
+}
+
+func (m *MemorySMQ) GetQueueAttributes(ctx context.Context, opts q.GetQueueAttributesOptions) (*q.QueueAttributes, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[opts.QName]
+	if !ok {
+		return nil, q.QueueNotFoundError
+	}
+	return qu.attributes(m.clock().UnixMilli()), nil
+}
+
+func (m *MemorySMQ) SetQueueAttributes(ctx context.Context, options q.SetAttributesOptions) (*q.QueueAttributes, error) {
+	if len(options.QName) == 0 {
+		return nil, errors.New("QName must be provided")
+	}
+	if options.DelayForMessages == nil && options.VisibilityTimeout == nil && options.Maxsize == nil &&
+		options.MessageRetentionSeconds == nil && options.DeadLetterQueue == nil && options.MaxReceivesPerSecond == nil &&
+		options.MaxMessages == nil && options.MaxBytes == nil {
+		return nil, errors.New("must provide a new value for at least one queue attribute")
+	}
+	if options.DeadLetterQueue != nil && *options.DeadLetterQueue == options.QName {
+		return nil, errors.New("DeadLetterQueue must be a different queue")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[options.QName]
+	if !ok {
+		return nil, q.QueueNotFoundError
+	}
+	now := m.clock()
+	qu.attrs.Modified = strconv.FormatInt(now.Unix(), 10)
+	if options.DelayForMessages != nil {
+		qu.attrs.DelayForMessages = *options.DelayForMessages
+	}
+	if options.Maxsize != nil {
+		qu.attrs.MaxSizeBytes = *options.Maxsize
+	}
+	if options.VisibilityTimeout != nil {
+		qu.attrs.VisibilityTimeout = *options.VisibilityTimeout
+	}
+	if options.MessageRetentionSeconds != nil {
+		qu.attrs.MessageRetentionSeconds = *options.MessageRetentionSeconds
+	}
+	if options.DeadLetterQueue != nil {
+		qu.attrs.DeadLetterQueue = *options.DeadLetterQueue
+	}
+	if options.MaxReceivesPerSecond != nil {
+		qu.attrs.MaxReceivesPerSecond = *options.MaxReceivesPerSecond
+	}
+	if options.MaxMessages != nil {
+		qu.attrs.MaxMessages = *options.MaxMessages
+	}
+	if options.MaxBytes != nil {
+		qu.attrs.MaxBytes = *options.MaxBytes
+	}
+	return qu.attributes(now.UnixMilli()), nil
+}
+
+// PauseQueue stops ReceiveMessage and PopMessage returning messages from the queue until ResumeQueue is called
+func (m *MemorySMQ) PauseQueue(ctx context.Context, options q.PauseQueueOptions) error {
+	return m.setPaused(options.QName, true)
+}
+
+// ResumeQueue lets a paused queue be received from again
+func (m *MemorySMQ) ResumeQueue(ctx context.Context, options q.ResumeQueueOptions) error {
+	return m.setPaused(options.QName, false)
+}
+
+func (m *MemorySMQ) setPaused(qname string, paused bool) error {
+	if len(qname) == 0 {
+		return errors.New("QName is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[qname]
+	if !ok {
+		return q.QueueNotFoundError
+	}
+	qu.attrs.Paused = paused
+	qu.attrs.Modified = strconv.FormatInt(m.clock().Unix(), 10)
+	return nil
+}
+
+func (m *MemorySMQ) SendMessage(ctx context.Context, opts q.SendMessageRequestOptions) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[opts.QName]
+	if !ok {
+		return "", q.QueueNotFoundError
+	}
+	if int64(len(opts.Message)) > qu.attrs.MaxSizeBytes {
+		return "", errors.New("Message is larger than allowed max size: " + strconv.FormatInt(qu.attrs.MaxSizeBytes, 10))
+	}
+	if qu.full(len(opts.Message)) {
+		return "", q.QueueFullError
+	}
+	now := m.clock()
+	// the queue delay is in seconds, as it is for RedisSMQ
+	delay := qu.attrs.DelayForMessages
+	if opts.Delay > 0 {
+		delay = opts.Delay
+	}
+	score := now.Add(time.Duration(delay) * time.Second).UnixMilli()
+	if !opts.DeliverAt.IsZero() {
+		score = opts.DeliverAt.UnixMilli()
+		if opts.DeliverAt.Before(now) {
+			score = now.UnixMilli()
+		}
+	}
+	msg := &message{
+		id:    q.MakeMessageID(now),
+		body:  opts.Message,
+		score: score,
+		exp:   q.ExpiresUnix(now, qu.attrs.MessageRetentionSeconds, opts.TTL),
+	}
+	if len(opts.Metadata) > 0 {
+		msg.meta = make(map[string]string, len(opts.Metadata))
+		for k, v := range opts.Metadata {
+			msg.meta[k] = v
+		}
+	}
+	qu.add(msg)
+	return msg.id, nil
+}
+
+func (m *MemorySMQ) ReceiveMessage(ctx context.Context, opts q.ReceiveMessageOptions) (*q.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[opts.QName]
+	if !ok {
+		return nil, fmt.Errorf("recieve message: %w", q.QueueNotFoundError)
+	}
+	vt := qu.attrs.VisibilityTimeout
+	if opts.VisibilityTimeout != nil {
+		vt = *opts.VisibilityTimeout
+	}
+	now := m.clock()
+	msg, err := m.next(qu, now.UnixMilli())
+	if msg == nil || err != nil {
+		return nil, err
+	}
+	deadline := now.Add(time.Duration(vt) * time.Second)
+	msg.score = deadline.UnixMilli()
+	msg.rc++
+	if msg.rc == 1 {
+		msg.fr = now.UnixMilli()
+	}
+	return msg.toMessage(deadline), nil
+}
+
+func (m *MemorySMQ) PopMessage(ctx context.Context, options q.PopMessageOptions) (*q.Message, error) {
+	if len(options.QName) == 0 {
+		return nil, errors.New("popMessage validation failed. Expected options.QName to be set")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[options.QName]
+	if !ok {
+		return nil, q.QueueNotFoundError
+	}
+	now := m.clock()
+	msg, err := m.next(qu, now.UnixMilli())
+	if msg == nil || err != nil {
+		return nil, err
+	}
+	msg.rc++
+	if msg.rc == 1 {
+		msg.fr = now.UnixMilli()
+	}
+	qu.remove(msg.id)
+	return msg.toMessage(now.Add(time.Duration(qu.attrs.VisibilityTimeout) * time.Second)), nil
+}
+
+func (m *MemorySMQ) DeleteMessage(ctx context.Context, options q.DeleteMessageRequest) error {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return errors.New("options.QNAME or options.ID was empty but it should not be empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if qu, ok := m.queues[options.QName]; ok {
+		qu.remove(options.ID)
+	}
+	return nil
+}
+
+func (m *MemorySMQ) ChangeMessageVisibility(ctx context.Context, options q.ChangeMessageVisibilityOptions) (bool, error) {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return false, fmt.Errorf("ChangeMessageVisibility requires QName and ID parameters")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	qu, ok := m.queues[options.QName]
+	if !ok {
+		return false, fmt.Errorf("getQueue: %w", q.QueueNotFoundError)
+	}
+	msg, ok := qu.messages[options.ID]
+	if !ok {
+		return false, nil
+	}
+	msg.score = m.clock().Add(time.Duration(options.VisibilityTimeout) * time.Second).UnixMilli()
+	return true, nil
+}
+
+func (m *MemorySMQ) Close() error {
+	return nil
+}
+
+// next applies the pause and rate limit of the queue and returns the first visible message which has not expired,
+// moving expired messages to the dead letter queue on the way. It mirrors scriptReceiveMessage.
+func (m *MemorySMQ) next(qu *queue, now int64) (*message, error) {
+	if qu.attrs.Paused {
+		return nil, nil
+	}
+	tokens, err := qu.bucket.Available(qu.attrs.MaxReceivesPerSecond, now)
+	if err != nil {
+		return nil, err
+	}
+	for expires := 0; ; expires++ {
+		msg := qu.first(now)
+		if msg == nil {
+			return nil, nil
+		}
+		if msg.exp > 0 && msg.exp <= now {
+			if expires == q.MaxExpiresPerReceive {
+				return nil, nil
+			}
+			m.expire(qu, msg, now)
+			continue
+		}
+		if qu.attrs.MaxReceivesPerSecond > 0 {
+			qu.bucket.Take(tokens, now)
+		}
+		qu.attrs.TotalReceived++
+		return msg, nil
+	}
+}
+
+func (m *MemorySMQ) expire(qu *queue, msg *message, now int64) {
+	qu.remove(msg.id)
+	dlq, ok := m.queues[qu.attrs.DeadLetterQueue]
+	if qu.attrs.DeadLetterQueue == "" || !ok {
+		return
+	}
+	if dlq.full(len(msg.body)) {
+		qu.attrs.DeadLetterDropped++
+		return
+	}
+	msg.score, msg.exp = now, 0
+	dlq.add(msg)
+}
+
+func (qu *queue) attributes(now int64) *q.QueueAttributes {
+	attrs := qu.attrs
+	attrs.CurrentN = int64(len(qu.messages))
+	for _, msg := range qu.messages {
+		// like RedisSMQ, messages visible from this millisecond are still counted as hidden
+		if msg.score >= now {
+			attrs.HiddenMessages++
+		}
+	}
+	return &attrs
+}
+
+func (qu *queue) full(size int) bool {
+	if qu.attrs.MaxMessages > 0 && int64(len(qu.messages)) >= qu.attrs.MaxMessages {
+		return true
+	}
+	return qu.attrs.MaxBytes > 0 && qu.attrs.CurrentBytes+int64(size) > qu.attrs.MaxBytes
+}
+
+func (qu *queue) add(msg *message) {
+	qu.messages[msg.id] = msg
+	qu.attrs.CurrentBytes += int64(len(msg.body))
+	qu.attrs.TotalSent++
+}
+
+func (qu *queue) remove(id string) {
+	msg, ok := qu.messages[id]
+	if !ok {
+		return
+	}
+	delete(qu.messages, id)
+	qu.attrs.CurrentBytes -= int64(len(msg.body))
+	if qu.attrs.CurrentBytes < 0 {
+		qu.attrs.CurrentBytes = 0
+	}
+}
+
+// first is the visible message with the lowest score, ties are broken by ID as they are in a redis sorted set
+func (qu *queue) first(now int64) *message {
+	var first *message
+	for _, msg := range qu.messages {
+		if msg.score > now {
+			continue
+		}
+		if first == nil || msg.score < first.score || (msg.score == first.score && msg.id < first.id) {
+			first = msg
+		}
+	}
+	return first
+}
+
+func (msg *message) toMessage(deadline time.Time) *q.Message {
+	var meta map[string]string
+	if len(msg.meta) > 0 {
+		meta = make(map[string]string, len(msg.meta))
+		for k, v := range msg.meta {
+			meta[k] = v
+		}
+	}
+	return &q.Message{
+		ID:       msg.id,
+		Message:  msg.body,
+		RC:       msg.rc,
+		FR:       time.UnixMilli(msg.fr),
+		Sent:     q.SentFromID(msg.id),
+		Deadline: &deadline,
+		Metadata: meta,
+	}
+}
@@ -0,0 +1,14 @@
+package memq
+
+import (
+	"github.com/ebuckley/rsmq/qtest"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	qtest.Run(t, func(t *testing.T) qtest.Backend {
+		clock := qtest.NewClock(time.Now())
+		return qtest.Backend{Queue: New(Options{Clock: clock.Now}), Now: clock.Now, Wait: clock.Advance}
+	})
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"context"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"math"
+	"time"
+)
+
+// Collector is a prometheus.Collector which reports the attributes of every queue returned by ListQueues
+type Collector struct {
+	mq      *q.RedisSMQ
+	timeout time.Duration
+	maxScan int64
+
+	messages         *prometheus.Desc
+	hiddenMessages   *prometheus.Desc
+	inFlightMessages *prometheus.Desc
+	delayedMessages  *prometheus.Desc
+	receiveCounts    *prometheus.Desc
+	sent             *prometheus.Desc
+	received         *prometheus.Desc
+	oldestVisibleAge *prometheus.Desc
+}
+
+// receiveCountBuckets group messages by receive count, the last bucket holds the rest,
+// so a poison message received over and over does not add a series for every receive
+var receiveCountBuckets = []struct {
+	label string
+	max   int64
+}{{"0", 0}, {"1", 1}, {"2", 2}, {"3-5", 5}, {"6-10", 10}, {"11+", math.MaxInt64}}
+
+type Options struct {
+	// Timeout bounds how long a scrape waits on redis, queues not reached in time are left out. Defaults to 5 seconds
+	Timeout time.Duration
+	// MaxScan is the most messages inspected per queue to count the delayed and in-flight messages. Defaults to q.DefaultStatsMaxScan
+	MaxScan int64
+}
+
+// NewCollector creates the Collector, register it with prometheus.MustRegister
+func NewCollector(mq *q.RedisSMQ, opts Options) *Collector {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	labels := []string{"queue"}
+	return &Collector{
+		mq:      mq,
+		timeout: timeout,
+		maxScan: opts.MaxScan,
+		messages: prometheus.NewDesc("rsmq_queue_messages",
+			"Number of messages in the queue, including hidden messages.", labels, nil),
+		hiddenMessages: prometheus.NewDesc("rsmq_queue_hidden_messages",
+			"Number of messages which are delayed or in flight.", labels, nil),
+		inFlightMessages: prometheus.NewDesc("rsmq_queue_in_flight_messages",
+			"Number of messages which have been received and not yet deleted or made visible again.", labels, nil),
+		delayedMessages: prometheus.NewDesc("rsmq_queue_delayed_messages",
+			"Number of messages which have not yet become visible for the first time.", labels, nil),
+		receiveCounts: prometheus.NewDesc("rsmq_queue_messages_by_receive_count",
+			"Number of messages on the queue by how many times they have been received, in the buckets 0, 1, 2, 3-5, 6-10 and 11+.", []string{"queue", "receive_count"}, nil),
+		sent: prometheus.NewDesc("rsmq_queue_sent_total",
+			"Total number of messages sent to the queue.", labels, nil),
+		received: prometheus.NewDesc("rsmq_queue_received_total",
+			"Total number of messages received from the queue.", labels, nil),
+		oldestVisibleAge: prometheus.NewDesc("rsmq_queue_oldest_visible_message_age_seconds",
+			"Time since the oldest visible message was sent.", labels, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.messages
+	ch <- c.hiddenMessages
+	ch <- c.inFlightMessages
+	ch <- c.delayedMessages
+	ch <- c.receiveCounts
+	ch <- c.sent
+	ch <- c.received
+	ch <- c.oldestVisibleAge
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	queues, err := c.mq.ListQueues(ctx)
+	if err != nil {
+		log.Println("rsmq metrics: list queues:", err)
+		return
+	}
+	for _, qname := range queues {
+		if err := c.collectQueue(ctx, ch, qname); err != nil {
+			log.Printf("rsmq metrics: queue %s: %s", qname, err)
+		}
+	}
+}
+
+func (c *Collector) collectQueue(ctx context.Context, ch chan<- prometheus.Metric, qname string) error {
+	attrs, err := c.mq.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+	if err != nil {
+		return err
+	}
+	stats, err := c.mq.GetQueueStats(ctx, q.GetQueueStatsOptions{QName: qname, MaxScan: c.maxScan})
+	if err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.messages, prometheus.GaugeValue, float64(attrs.CurrentN), qname)
+	// attrs.HiddenMessages counts messages which became visible this millisecond, the stats leave them out
+	ch <- prometheus.MustNewConstMetric(c.hiddenMessages, prometheus.GaugeValue, float64(stats.Messages-stats.Visible), qname)
+	ch <- prometheus.MustNewConstMetric(c.inFlightMessages, prometheus.GaugeValue, float64(stats.InFlight), qname)
+	ch <- prometheus.MustNewConstMetric(c.delayedMessages, prometheus.GaugeValue, float64(stats.Delayed), qname)
+	ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(attrs.TotalSent), qname)
+	ch <- prometheus.MustNewConstMetric(c.received, prometheus.CounterValue, float64(attrs.TotalReceived), qname)
+	ch <- prometheus.MustNewConstMetric(c.oldestVisibleAge, prometheus.GaugeValue, stats.OldestVisibleAge.Seconds(), qname)
+	counts := make([]int64, len(receiveCountBuckets))
+	for rc, n := range stats.ReceiveCounts {
+		for i, b := range receiveCountBuckets {
+			if rc <= b.max {
+				counts[i] += n
+				break
+			}
+		}
+	}
+	for i, b := range receiveCountBuckets {
+		ch <- prometheus.MustNewConstMetric(c.receiveCounts, prometheus.GaugeValue, float64(counts[i]), qname, b.label)
+	}
+	return nil
+}
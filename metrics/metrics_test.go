@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/ebuckley/rsmq/qtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	ctx := context.Background()
+	ns := fmt.Sprintf("metrics-test-%d", rand.Int63())
+	mq, err := q.New(ctx, q.Options{Client: qtest.RedisClient(t), NameSpace: &ns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close()
+	qname := "orders"
+	err = mq.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.DeleteQueue(ctx, q.DeleteQueueRequestOptions{QName: qname})
+	for i := 0; i < 3; i++ {
+		_, err := mq.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "order"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = mq.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP rsmq_queue_delayed_messages Number of messages which have not yet become visible for the first time.
+# TYPE rsmq_queue_delayed_messages gauge
+rsmq_queue_delayed_messages{queue="orders"} 0
+# HELP rsmq_queue_hidden_messages Number of messages which are delayed or in flight.
+# TYPE rsmq_queue_hidden_messages gauge
+rsmq_queue_hidden_messages{queue="orders"} 1
+# HELP rsmq_queue_in_flight_messages Number of messages which have been received and not yet deleted or made visible again.
+# TYPE rsmq_queue_in_flight_messages gauge
+rsmq_queue_in_flight_messages{queue="orders"} 1
+# HELP rsmq_queue_messages Number of messages in the queue, including hidden messages.
+# TYPE rsmq_queue_messages gauge
+rsmq_queue_messages{queue="orders"} 3
+# HELP rsmq_queue_messages_by_receive_count Number of messages on the queue by how many times they have been received, in the buckets 0, 1, 2, 3-5, 6-10 and 11+.
+# TYPE rsmq_queue_messages_by_receive_count gauge
+rsmq_queue_messages_by_receive_count{queue="orders",receive_count="0"} 2
+rsmq_queue_messages_by_receive_count{queue="orders",receive_count="1"} 1
+rsmq_queue_messages_by_receive_count{queue="orders",receive_count="11+"} 0
+rsmq_queue_messages_by_receive_count{queue="orders",receive_count="2"} 0
+rsmq_queue_messages_by_receive_count{queue="orders",receive_count="3-5"} 0
+rsmq_queue_messages_by_receive_count{queue="orders",receive_count="6-10"} 0
+# HELP rsmq_queue_received_total Total number of messages received from the queue.
+# TYPE rsmq_queue_received_total counter
+rsmq_queue_received_total{queue="orders"} 1
+# HELP rsmq_queue_sent_total Total number of messages sent to the queue.
+# TYPE rsmq_queue_sent_total counter
+rsmq_queue_sent_total{queue="orders"} 3
+`
+	c := NewCollector(mq, Options{})
+	err = testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"rsmq_queue_delayed_messages",
+		"rsmq_queue_hidden_messages",
+		"rsmq_queue_in_flight_messages",
+		"rsmq_queue_messages",
+		"rsmq_queue_messages_by_receive_count",
+		"rsmq_queue_received_total",
+		"rsmq_queue_sent_total",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(c, "rsmq_queue_oldest_visible_message_age_seconds"); n != 1 {
+		t.Fatalf("expected the oldest visible message age for 1 queue but got %d", n)
+	}
+}
@@ -0,0 +1,251 @@
+package q
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strings"
+)
+
+// leftoverSuffixes are message fields the nodejs rsmq does not know about, so it leaves them behind when it deletes a message
+var leftoverSuffixes = map[string]bool{
+	"exp":  true,
+	"meta": true,
+}
+
+// queueAttributeFields are the fields of the queue hash which are not part of a message
+var queueAttributeFields = map[string]bool{
+	"createdby":   true,
+	"vt":          true,
+	"delay":       true,
+	"maxsize":     true,
+	"totalrecv":   true,
+	"totalsent":   true,
+	"created":     true,
+	"modified":    true,
+	"retention":   true,
+	"dlq":         true,
+	"maxrecvrate": true,
+	"maxmsgs":     true,
+	"maxbytes":    true,
+	"bytes":       true,
+	"paused":      true,
+	"dlqdropped":  true,
+}
+
+type CheckQueueOptions struct {
+	QName string
+}
+
+type RepairQueueOptions struct {
+	QName string
+}
+
+// QueueReport lists each class of inconsistency found in a queue
+type QueueReport struct {
+	QName string
+	// MissingAttributes is set when the queue is listed in QUEUES but has no attributes hash
+	MissingAttributes bool
+	// Unregistered is set when the queue has an attributes hash but is not listed in QUEUES
+	Unregistered bool
+	// OrphanFields are body, rc, fr or exp fields of messages which are not on the queue
+	OrphanFields []string
+	// MissingBodies are IDs of messages on the queue which have no body
+	MissingBodies []string
+	// Leftovers are exp and meta fields of messages deleted by a client that does not know about them,
+	// they are harmless and not counted as an inconsistency, RepairQueue removes them
+	Leftovers []string `json:",omitempty"`
+	// Repaired is set when the inconsistencies were fixed
+	Repaired bool
+}
+
+// Consistent is true when no inconsistencies were found
+func (r QueueReport) Consistent() bool {
+	return !r.MissingAttributes && !r.Unregistered && len(r.OrphanFields) == 0 && len(r.MissingBodies) == 0
+}
+
+func (r QueueReport) String() string {
+	marshal, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Sprintf("Could not marshal QueueReport: %s", err)
+	}
+	return string(marshal)
+}
+
+// CheckQueue scans the queue for inconsistencies without modifying it.
+func (rsmq *RedisSMQ) CheckQueue(ctx context.Context, options CheckQueueOptions) (*QueueReport, error) {
+	return rsmq.checkQueue(ctx, options.QName, false)
+}
+
+// RepairQueue scans the queue for inconsistencies and fixes them.
+// It is safe to run while messages are being sent and received,
+// each fix is re-checked atomically before anything is removed.
+func (rsmq *RedisSMQ) RepairQueue(ctx context.Context, options RepairQueueOptions) (*QueueReport, error) {
+	return rsmq.checkQueue(ctx, options.QName, true)
+}
+
+func (rsmq *RedisSMQ) checkQueue(ctx context.Context, qname string, repair bool) (*QueueReport, error) {
+	if len(qname) == 0 {
+		return nil, fmt.Errorf("checkQueue requires a QName")
+	}
+	key := rsmq.ns + ":" + qname
+	report := &QueueReport{QName: qname}
+
+	pipe := rsmq.cl.Pipeline()
+	registered := pipe.SIsMember(ctx, rsmq.ns+":QUEUES", qname)
+	exists := pipe.Exists(ctx, key+":Q")
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("checkQueue %s: %w", qname, err)
+	}
+	if exists.Val() == 0 && !registered.Val() {
+		return nil, QueueNotFoundError
+	}
+	report.MissingAttributes = exists.Val() == 0
+	report.Unregistered = !registered.Val()
+
+	if report.MissingAttributes {
+		// without attributes the queue can never be received from, so it is removed entirely
+		if repair {
+			pipe := rsmq.cl.TxPipeline()
+			pipe.SRem(ctx, rsmq.ns+":QUEUES", qname)
+			pipe.Del(ctx, key)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return nil, fmt.Errorf("checkQueue %s: remove queue: %w", qname, err)
+			}
+			report.Repaired = true
+		}
+		return report, nil
+	}
+
+	report.OrphanFields, report.Leftovers, err = rsmq.orphanFields(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("checkQueue %s: %w", qname, err)
+	}
+	report.MissingBodies, err = rsmq.missingBodies(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("checkQueue %s: %w", qname, err)
+	}
+	if !repair {
+		return report, nil
+	}
+	if len(report.Leftovers) > 0 {
+		args := append([]string{key}, report.Leftovers...)
+		if err := removeOrphanFieldsScript.Run(ctx, rsmq.cl, args).Err(); err != nil {
+			return nil, fmt.Errorf("checkQueue %s: eval removeOrphanFieldsScript: %w", qname, err)
+		}
+	}
+	if report.Consistent() {
+		return report, nil
+	}
+
+	if report.Unregistered {
+		if err := rsmq.cl.SAdd(ctx, rsmq.ns+":QUEUES", qname).Err(); err != nil {
+			return nil, fmt.Errorf("checkQueue %s: register queue: %w", qname, err)
+		}
+	}
+	if len(report.OrphanFields) > 0 {
+		args := append([]string{key}, report.OrphanFields...)
+		if err := removeOrphanFieldsScript.Run(ctx, rsmq.cl, args).Err(); err != nil {
+			return nil, fmt.Errorf("checkQueue %s: eval removeOrphanFieldsScript: %w", qname, err)
+		}
+	}
+	if len(report.MissingBodies) > 0 {
+		args := append([]string{key}, report.MissingBodies...)
+		if err := removeBodilessScript.Run(ctx, rsmq.cl, args).Err(); err != nil {
+			return nil, fmt.Errorf("checkQueue %s: eval removeBodilessScript: %w", qname, err)
+		}
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// orphanFields scans the queue hash for message fields whose message is not in the queue sorted set,
+// messages with nothing but leftover fields are returned separately
+func (rsmq *RedisSMQ) orphanFields(ctx context.Context, key string) ([]string, []string, error) {
+	var orphans, leftovers []string
+	var cursor uint64
+	for {
+		fields, next, err := rsmq.cl.HScan(ctx, key+":Q", cursor, "", 100).Result()
+		if err != nil {
+			return nil, nil, fmt.Errorf("hscan: %w", err)
+		}
+		// HSCAN returns field, value pairs
+		byID := map[string][]string{}
+		for i := 0; i < len(fields); i += 2 {
+			if queueAttributeFields[fields[i]] {
+				continue
+			}
+			id, _, _ := strings.Cut(fields[i], ":")
+			byID[id] = append(byID[id], fields[i])
+		}
+		if len(byID) > 0 {
+			pipe := rsmq.cl.Pipeline()
+			scores := map[string]*redis.FloatCmd{}
+			for id := range byID {
+				scores[id] = pipe.ZScore(ctx, key, id)
+			}
+			// a member which is not on the queue fails with redis.Nil, which is checked per command below
+			_, _ = pipe.Exec(ctx)
+			for id, score := range scores {
+				err := score.Err()
+				if errors.Is(err, redis.Nil) && onlyLeftovers(byID[id]) {
+					leftovers = append(leftovers, byID[id]...)
+				} else if errors.Is(err, redis.Nil) {
+					orphans = append(orphans, byID[id]...)
+				} else if err != nil {
+					return nil, nil, fmt.Errorf("zscore: %w", err)
+				}
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return orphans, leftovers, nil
+		}
+	}
+}
+
+// onlyLeftovers is true when every field has a leftover suffix
+func onlyLeftovers(fields []string) bool {
+	for _, field := range fields {
+		_, suffix, _ := strings.Cut(field, ":")
+		if !leftoverSuffixes[suffix] {
+			return false
+		}
+	}
+	return true
+}
+
+// missingBodies scans the queue sorted set for messages that have no body in the queue hash
+func (rsmq *RedisSMQ) missingBodies(ctx context.Context, key string) ([]string, error) {
+	var missing []string
+	var cursor uint64
+	for {
+		members, next, err := rsmq.cl.ZScan(ctx, key, cursor, "", 100).Result()
+		if err != nil {
+			return nil, fmt.Errorf("zscan: %w", err)
+		}
+		// ZSCAN returns member, score pairs
+		var ids []string
+		for i := 0; i < len(members); i += 2 {
+			ids = append(ids, members[i])
+		}
+		if len(ids) > 0 {
+			bodies, err := rsmq.cl.HMGet(ctx, key+":Q", ids...).Result()
+			if err != nil {
+				return nil, fmt.Errorf("hmget: %w", err)
+			}
+			for i, body := range bodies {
+				if body == nil {
+					missing = append(missing, ids[i])
+				}
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return missing, nil
+		}
+	}
+}
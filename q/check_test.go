@@ -0,0 +1,88 @@
+package q
+
+import (
+	"github.com/go-redis/redis/v8"
+	"testing"
+)
+
+func TestCheckAndRepairQueue(t *testing.T) {
+	qName, q, ctx, err := newQ("TestCheckQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "consistent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := q.ns + ":" + qName
+	// the body of a message which lost its zset member is still counted in bytes
+	q.cl.HSet(ctx, key+":Q", "ghost", "body without a message", "ghost:rc", 1)
+	q.cl.HIncrBy(ctx, key+":Q", "bytes", int64(len("body without a message")))
+	q.cl.ZAdd(ctx, key, &redis.Z{Score: 0, Member: "nobody"})
+	q.cl.SRem(ctx, q.ns+":QUEUES", qName)
+	// the nodejs rsmq leaves these behind when it deletes a message
+	q.cl.HSet(ctx, key+":Q", "deleted:exp", 1, "deleted:meta", "{}")
+
+	report, err := q.CheckQueue(ctx, CheckQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Unregistered || len(report.OrphanFields) != 2 || len(report.MissingBodies) != 1 || len(report.Leftovers) != 2 || report.Repaired {
+		t.Fatalf("expected every inconsistency to be reported but got %s", report)
+	}
+
+	report, err = q.RepairQueue(ctx, RepairQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired {
+		t.Fatalf("expected the queue to be repaired but got %s", report)
+	}
+	report, err = q.CheckQueue(ctx, CheckQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || len(report.Leftovers) > 0 {
+		t.Fatalf("expected the queue to be consistent after repair but got %s", report)
+	}
+	if _, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: kept}); err != nil {
+		t.Fatalf("repair should not remove consistent messages but got %v", err)
+	}
+	attributes, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.CurrentBytes != int64(len("consistent")) {
+		t.Fatalf("expected only the consistent message to be counted in bytes but got %s", attributes)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestRepairQueueWithoutAttributes(t *testing.T) {
+	qName, q, ctx, err := newQ("TestRepairPhantom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.cl.Del(ctx, q.ns+":"+qName+":Q")
+
+	report, err := q.RepairQueue(ctx, RepairQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.MissingAttributes || !report.Repaired {
+		t.Fatalf("expected the queue without attributes to be removed but got %s", report)
+	}
+	queues, err := q.ListQueues(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range queues {
+		if name == qName {
+			t.Fatal("expected the queue to be removed from QUEUES")
+		}
+	}
+	if _, err := q.CheckQueue(ctx, CheckQueueOptions{QName: qName}); err != QueueNotFoundError {
+		t.Fatalf("expected QueueNotFoundError after repair but got %v", err)
+	}
+}
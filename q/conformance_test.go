@@ -0,0 +1,26 @@
+package q_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/ebuckley/rsmq/qtest"
+	"math/rand"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	qtest.Run(t, func(t *testing.T) qtest.Backend {
+		// each case gets its own namespace so ListQueues only returns its queues
+		ns := fmt.Sprintf("conformance-%d", rand.Int63())
+		mq, err := q.New(context.Background(), q.Options{Client: qtest.RedisClient(t), NameSpace: &ns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return qtest.RealTime(mq)
+	})
+}
+
+func TestNodeLayout(t *testing.T) {
+	qtest.RunNodeLayout(t, qtest.RedisClient(t), fmt.Sprintf("layout-%d", rand.Int63()))
+}
@@ -0,0 +1,283 @@
+package q
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"sort"
+	"strconv"
+)
+
+type ExportQueueOptions struct {
+	QName string
+}
+
+// ImportMode chooses what ImportQueue restores as it was exported, modes can be combined with |
+type ImportMode int
+
+const (
+	// ImportPreserve restores visibility, receive counts and the totalsent and totalrecv counters as they were exported
+	ImportPreserve ImportMode = 0
+	// ImportResetVisibility makes every message visible immediately, including delayed and in flight messages
+	ImportResetVisibility ImportMode = 1
+	// ImportResetCounters imports messages as never received, and starts the totalsent and totalrecv counters from 0
+	ImportResetCounters ImportMode = 2
+)
+
+type ImportQueueOptions struct {
+	QName string
+	Mode  ImportMode
+}
+
+// exportHeader is the first line of an export
+type exportHeader struct {
+	QName      string            `json:"qname"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// ExportedMessage is a line of an export after the header
+type ExportedMessage struct {
+	ID   string `json:"id"`
+	Body string `json:"body"`
+	// Score is the unix millisecond time the message is visible from
+	Score int64 `json:"score"`
+	RC    int64 `json:"rc,omitempty"`
+	// FR is the unix millisecond time of the first receive
+	FR int64 `json:"fr,omitempty"`
+	// Exp is the unix millisecond time the message expires
+	Exp int64 `json:"exp,omitempty"`
+	// Meta is the encoded message metadata
+	Meta string `json:"meta,omitempty"`
+}
+
+// ExportQueue writes the queue attributes followed by every message to w as JSON Lines, and returns the number of messages written.
+// Messages sent or deleted while the export runs may or may not be included.
+func (rsmq *RedisSMQ) ExportQueue(ctx context.Context, options ExportQueueOptions, w io.Writer) (int64, error) {
+	if len(options.QName) == 0 {
+		return 0, errors.New("ExportQueue: QName is empty")
+	}
+	key := rsmq.ns + ":" + options.QName
+	attributes, err := rsmq.exportAttributes(ctx, key)
+	if errors.Is(err, QueueNotFoundError) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ExportQueue: %w", err)
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(exportHeader{QName: options.QName, Attributes: attributes}); err != nil {
+		return 0, fmt.Errorf("ExportQueue: %w", err)
+	}
+	var exported int64
+	err = rsmq.scanMessages(ctx, key, func(batch []*ExportedMessage) error {
+		for _, m := range batch {
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+			exported++
+		}
+		return nil
+	})
+	if err != nil {
+		return exported, fmt.Errorf("ExportQueue: %w", err)
+	}
+	return exported, nil
+}
+
+// exportAttributes reads the attribute fields of the queue hash, or returns QueueNotFoundError
+func (rsmq *RedisSMQ) exportAttributes(ctx context.Context, key string) (map[string]string, error) {
+	fields := make([]string, 0, len(queueAttributeFields))
+	for f := range queueAttributeFields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	vals, err := rsmq.cl.HMGet(ctx, key+":Q", fields...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("hmget: %w", err)
+	}
+	attributes := map[string]string{}
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			attributes[fields[i]] = s
+		}
+	}
+	if _, ok := attributes["vt"]; !ok {
+		return nil, QueueNotFoundError
+	}
+	return attributes, nil
+}
+
+// scanMessages calls fn with each batch of messages on the queue, messages deleted during the scan are left out
+func (rsmq *RedisSMQ) scanMessages(ctx context.Context, key string, fn func(batch []*ExportedMessage) error) error {
+	// ZSCAN can return a member more than once
+	seen := map[string]bool{}
+	var cursor uint64
+	for {
+		members, next, err := rsmq.cl.ZScan(ctx, key, cursor, "", 100).Result()
+		if err != nil {
+			return fmt.Errorf("zscan: %w", err)
+		}
+		// ZSCAN returns member, score pairs
+		pipe := rsmq.cl.Pipeline()
+		var msgs []*ExportedMessage
+		var cmds []*redis.SliceCmd
+		for i := 0; i+1 < len(members); i += 2 {
+			id := members[i]
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			score, err := strconv.ParseFloat(members[i+1], 64)
+			if err != nil {
+				return fmt.Errorf("could not parse the score of %s: %w", id, err)
+			}
+			msgs = append(msgs, &ExportedMessage{ID: id, Score: int64(score)})
+			cmds = append(cmds, pipe.HMGet(ctx, key+":Q", id, id+":rc", id+":fr", id+":exp", id+":meta"))
+		}
+		if len(cmds) > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return fmt.Errorf("hmget: %w", err)
+			}
+		}
+		batch := make([]*ExportedMessage, 0, len(msgs))
+		for i, m := range msgs {
+			vals := cmds[i].Val()
+			body, ok := vals[0].(string)
+			if !ok {
+				// deleted since the scan
+				continue
+			}
+			m.Body = body
+			for j, field := range []*int64{&m.RC, &m.FR, &m.Exp} {
+				if s, ok := vals[j+1].(string); ok {
+					if *field, err = strconv.ParseInt(s, 10, 64); err != nil {
+						return fmt.Errorf("could not parse the fields of %s: %w", m.ID, err)
+					}
+				}
+			}
+			if meta, ok := vals[4].(string); ok {
+				m.Meta = meta
+			}
+			batch = append(batch, m)
+		}
+		if len(batch) > 0 {
+			if err := fn(batch); err != nil {
+				return err
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// ImportQueue reads an export written by ExportQueue from r into QName, and returns the number of messages imported.
+// The queue is created with the exported attributes and counters when it does not exist, an existing queue keeps its own.
+// Messages already on the queue are skipped, and QueueFullError is returned when the queue fills up.
+func (rsmq *RedisSMQ) ImportQueue(ctx context.Context, options ImportQueueOptions, r io.Reader) (int64, error) {
+	if len(options.QName) == 0 {
+		return 0, errors.New("ImportQueue: QName is empty")
+	}
+	dec := json.NewDecoder(r)
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("ImportQueue: read header: %w", err)
+	}
+	if _, ok := header.Attributes["vt"]; !ok {
+		return 0, errors.New("ImportQueue: the export has no queue attributes")
+	}
+	if err := rsmq.importAttributes(ctx, options.QName, header.Attributes, options.Mode); err != nil {
+		return 0, fmt.Errorf("ImportQueue: %w", err)
+	}
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return 0, err
+	}
+	key := rsmq.ns + ":" + options.QName
+	var imported int64
+	for {
+		var m ExportedMessage
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("ImportQueue: read message: %w", err)
+		}
+		res, err := rsmq.importMessage(ctx, key, &m, options.Mode, q.TimeSent.UnixMilli())
+		if errors.Is(err, QueueFullError) {
+			return imported, err
+		}
+		if err != nil {
+			return imported, fmt.Errorf("ImportQueue: %w", err)
+		}
+		imported += res
+	}
+	return imported, nil
+}
+
+// importMessage adds m to the queue at key, and returns 0 when it is already there or QueueFullError.
+// now is the score of messages when visibility is reset
+func (rsmq *RedisSMQ) importMessage(ctx context.Context, key string, m *ExportedMessage, mode ImportMode, now int64) (int64, error) {
+	score := m.Score
+	if mode&ImportResetVisibility != 0 {
+		score = now
+	}
+	var rc, fr, exp string
+	if mode&ImportResetCounters == 0 && m.RC > 0 {
+		rc = strconv.FormatInt(m.RC, 10)
+		fr = strconv.FormatInt(m.FR, 10)
+	}
+	if m.Exp > 0 {
+		exp = strconv.FormatInt(m.Exp, 10)
+	}
+	args := []string{key, m.ID, strconv.FormatInt(score, 10), m.Body, rc, fr, exp, m.Meta}
+	res, err := importMessageScript.Run(ctx, rsmq.cl, args).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if res < 0 {
+		return 0, QueueFullError
+	}
+	return res, nil
+}
+
+// importAttributes creates qname with the exported attributes when it does not exist yet
+func (rsmq *RedisSMQ) importAttributes(ctx context.Context, qname string, attributes map[string]string, mode ImportMode) error {
+	key := rsmq.ns + ":" + qname + ":Q"
+	now, err := rsmq.cl.Time(ctx).Result()
+	if err != nil {
+		return fmt.Errorf("create queue: %w", err)
+	}
+	fields := map[string]interface{}{}
+	for f, v := range attributes {
+		// bytes is counted as the messages are added
+		if !queueAttributeFields[f] || f == "bytes" {
+			continue
+		}
+		if mode&ImportResetCounters != 0 && (f == "totalsent" || f == "totalrecv" || f == "dlqdropped") {
+			continue
+		}
+		fields[f] = v
+	}
+	fields["created"] = now.Unix()
+	fields["modified"] = now.Unix()
+	created, err := rsmq.cl.HSetNX(ctx, key, "vt", fields["vt"]).Result()
+	if err != nil {
+		return fmt.Errorf("create queue: %w", err)
+	}
+	if !created {
+		return nil
+	}
+	pipe := rsmq.cl.TxPipeline()
+	pipe.HSet(ctx, key, fields)
+	pipe.SAdd(ctx, rsmq.ns+":QUEUES", qname)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("create queue: %w", err)
+	}
+	return nil
+}
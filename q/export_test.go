@@ -0,0 +1,144 @@
+package q
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExportImportQueue(t *testing.T) {
+	qName, q, ctx, err := newQ("TestExportQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	inFlight, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "in flight"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil || received == nil || received.ID != inFlight {
+		t.Fatalf("expected to receive %s but got %s %v", inFlight, received, err)
+	}
+	visible, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "visible", Metadata: map[string]string{"k": "v"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delayed, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "delayed", DeliverAt: time.Now().Add(time.Hour), TTL: 7200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := q.ExportQueue(ctx, ExportQueueOptions{QName: qName}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || bytes.Count(buf.Bytes(), []byte("\n")) != 4 {
+		t.Fatalf("expected a header and 3 messages but got %d messages in %s", n, buf.String())
+	}
+	export := buf.Bytes()
+
+	restored := qName + "Restored"
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: restored})
+	n, err = q.ImportQueue(ctx, ImportQueueOptions{QName: restored}, bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 messages to be imported but got %d", n)
+	}
+	for _, id := range []string{inFlight, visible, delayed} {
+		want, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := q.GetMessage(ctx, GetMessageOptions{QName: restored, ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("expected the imported message to be %s but got %s", want, got)
+		}
+	}
+	want, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: restored})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TotalSent != 3 || got.TotalReceived != 1 || got.HiddenMessages != 2 || got.CurrentBytes != want.CurrentBytes {
+		t.Fatalf("expected the counters of %s but got %s", want, got)
+	}
+
+	// importing again skips the messages which are already there
+	n, err = q.ImportQueue(ctx, ImportQueueOptions{QName: restored}, bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no messages to be imported a second time but got %d", n)
+	}
+	got, err = q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: restored})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TotalSent != 3 || got.TotalReceived != 1 {
+		t.Fatalf("expected the counters of an existing queue to be kept but got %s", got)
+	}
+
+	reset := qName + "Reset"
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: reset})
+	_, err = q.ImportQueue(ctx, ImportQueueOptions{QName: reset, Mode: ImportResetVisibility | ImportResetCounters}, bytes.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// messages visible from the current millisecond are still counted as hidden
+	time.Sleep(2 * time.Millisecond)
+	attrs, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: reset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.CurrentN != 3 || attrs.HiddenMessages != 0 || attrs.TotalSent != 0 || attrs.TotalReceived != 0 {
+		t.Fatalf("expected 3 visible messages and no counters but got %s", attrs)
+	}
+	msg, err := q.GetMessage(ctx, GetMessageOptions{QName: reset, ID: inFlight})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.RC != 0 || !msg.FR.IsZero() || msg.State != MessageVisible {
+		t.Fatalf("expected %s to be visible and never received but got %s", inFlight, msg)
+	}
+}
+
+func TestImportQueueFull(t *testing.T) {
+	qName, q, ctx, err := newQ("TestImportQueueFull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	for i := 0; i < 2; i++ {
+		if _, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "message"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := q.ExportQueue(ctx, ExportQueueOptions{QName: qName}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	full, _, _, err := newQ("TestImportQueueFull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: full})
+	maxMessages := int64(1)
+	if _, err := q.SetQueueAttributes(ctx, SetAttributesOptions{QName: full, MaxMessages: &maxMessages}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := q.ImportQueue(ctx, ImportQueueOptions{QName: full}, &buf)
+	if err != QueueFullError || n != 1 {
+		t.Fatalf("expected QueueFullError after 1 message but got %d %v", n, err)
+	}
+}
@@ -0,0 +1,57 @@
+package q
+
+import (
+	"crypto/rand"
+	"log"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// MakeMessageID returns an ID in the same format as smrchy/rsmq.
+// The first 10 characters are the base36 encoded send time in microseconds, followed by 22 random characters.
+func MakeMessageID(t time.Time) string {
+	ts := strconv.FormatInt(t.UnixMicro(), 36)
+	for len(ts) < 10 {
+		ts = "0" + ts
+	}
+	return ts + makeUID(22)
+}
+
+// SentFromID decodes the send time from an ID made by MakeMessageID, or returns the zero time for other IDs
+func SentFromID(id string) time.Time {
+	if len(id) != 32 {
+		return time.Time{}
+	}
+	us, err := strconv.ParseInt(id[:10], 36, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMicro(us)
+}
+
+// ExpiresUnix is the unix millisecond time a message sent at now expires, the sooner of its ttl and the queue retention in seconds.
+// It is 0 when neither applies
+func ExpiresUnix(now time.Time, retention int, ttl int) int64 {
+	if retention > 0 && (ttl <= 0 || retention < ttl) {
+		ttl = retention
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(time.Duration(ttl) * time.Second).UnixMilli()
+}
+
+// makeUID returns a cryptographically random ID for a string
+func makeUID(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+	s := make([]rune, n)
+	for i := range s {
+		b, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+		if err != nil {
+			log.Fatalln("Fatal error making a secure unique ID:", err)
+		}
+		s[i] = letters[b.Int64()]
+	}
+	return string(s)
+}
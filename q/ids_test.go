@@ -0,0 +1,22 @@
+package q
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSentFromID(t *testing.T) {
+	sent := time.UnixMicro(time.Now().UnixMicro())
+	id := MakeMessageID(sent)
+	if len(id) != 32 {
+		t.Fatalf("expected a 32 character ID but got %s", id)
+	}
+	if got := SentFromID(id); !got.Equal(sent) {
+		t.Fatalf("expected %s to decode to %s but got %s", id, sent, got)
+	}
+	for _, id := range []string{"", "short", "not a message id made by rsmq"} {
+		if got := SentFromID(id); !got.IsZero() {
+			t.Fatalf("expected the zero time for %q but got %s", id, got)
+		}
+	}
+}
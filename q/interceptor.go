@@ -0,0 +1,46 @@
+package q
+
+import (
+	"context"
+	"fmt"
+)
+
+// Call describes an intercepted operation on the queue
+type Call struct {
+	// Method is the name of the RedisSMQ method, e.g. "SendMessage"
+	Method string
+	QName  string
+	// Options is the options struct the method was called with, e.g. SendMessageRequestOptions.
+	// An interceptor may replace it with a modified value of the same type before calling next.
+	Options interface{}
+}
+
+// CallHandler performs the call, it returns the result of the method or nil if the method only returns an error.
+// The result is a string for SendMessage, *Message for ReceiveMessage and PopMessage and bool for ChangeMessageVisibility
+type CallHandler func(ctx context.Context, call *Call) (interface{}, error)
+
+// Interceptor wraps a call, in the style of a grpc unary interceptor.
+// It must call next to continue the chain, and may inspect or replace the result and error it returns.
+type Interceptor func(ctx context.Context, call *Call, next CallHandler) (interface{}, error)
+
+// intercept runs the call through the interceptor chain, the first interceptor being the outermost
+func (rsmq *RedisSMQ) intercept(ctx context.Context, call *Call, handler CallHandler) (interface{}, error) {
+	if len(rsmq.interceptors) == 0 {
+		return handler(ctx, call)
+	}
+	return chain(rsmq.interceptors, handler)(ctx, call)
+}
+
+func chain(interceptors []Interceptor, handler CallHandler) CallHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, call *Call) (interface{}, error) {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return handler
+}
+
+func invalidCallOptions(call *Call) error {
+	return fmt.Errorf("%s: an interceptor replaced the options with an unexpected type %T", call.Method, call.Options)
+}
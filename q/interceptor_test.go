@@ -0,0 +1,80 @@
+package q
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	ctx := context.Background()
+	cl, err := testClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	logging := func(ctx context.Context, call *Call, next CallHandler) (interface{}, error) {
+		calls = append(calls, call.Method+" "+call.QName)
+		return next(ctx, call)
+	}
+	// upper cases bodies on the way in and reverses that on the way out
+	transform := func(ctx context.Context, call *Call, next CallHandler) (interface{}, error) {
+		if send, ok := call.Options.(SendMessageRequestOptions); ok {
+			send.Message = strings.ToUpper(send.Message)
+			call.Options = send
+		}
+		res, err := next(ctx, call)
+		if msg, ok := res.(*Message); ok && msg != nil {
+			msg.Message = strings.ToLower(msg.Message)
+		}
+		return res, err
+	}
+	denied := errors.New("denied")
+	auth := func(ctx context.Context, call *Call, next CallHandler) (interface{}, error) {
+		if call.Method == "DeleteMessage" {
+			return nil, denied
+		}
+		return next(ctx, call)
+	}
+	q, err := New(ctx, Options{Client: cl, Interceptors: []Interceptor{logging, transform, auth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qName := "TestInterceptors" + makeUID(4)
+	err = q.CreateQueue(ctx, CreateQueueRequestOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uid, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Message != "HELLO" {
+		t.Fatalf("expected the interceptor to transform the stored body but got %q", stored.Message)
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.Message != "hello" {
+		t.Fatalf("expected the interceptor to transform the received body but got %s", message)
+	}
+	err = q.DeleteMessage(ctx, DeleteMessageRequest{QName: qName, ID: uid})
+	if err != denied {
+		t.Fatalf("expected the auth interceptor to deny the delete but got %v", err)
+	}
+
+	expected := fmt.Sprintf("[SendMessage %[1]s ReceiveMessage %[1]s DeleteMessage %[1]s]", qName)
+	if fmt.Sprint(calls) != expected {
+		t.Fatalf("expected calls %s but got %v", expected, calls)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
@@ -0,0 +1,313 @@
+package q
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+type CopyNamespaceOptions struct {
+	// Destination is where the queues are copied to, it can use another namespace, another redis instance or both
+	Destination *RedisSMQ
+	// QNames limits the copy to these queues, every queue in the namespace is copied when it is empty
+	QNames []string
+}
+
+type RenameQueueOptions struct {
+	QName string
+	// NewQName is the name of the queue in Destination, it defaults to QName
+	NewQName string
+	// Destination is where the queue is moved to, it defaults to the same namespace and redis instance
+	Destination *RedisSMQ
+	// PollInterval is the wait between passes while producers or consumers keep QName from emptying,
+	// defaults to DefaultRenamePollInterval
+	PollInterval time.Duration
+}
+
+// DefaultRenamePollInterval is the wait between the passes of RenameQueue when no PollInterval is given
+const DefaultRenamePollInterval = 500 * time.Millisecond
+
+// MigrationReport is the result of copying or renaming a queue
+type MigrationReport struct {
+	QName    string
+	NewQName string
+	// Copied is the number of messages written to the destination, messages it already held are not counted
+	Copied int64
+	// Missing are IDs of messages on the source which were not on the destination when the copy was verified,
+	// they were sent after the copy passed them. Copying again picks them up.
+	Missing []string
+	// NotMigrated are IDs of messages which were received, changed or deleted on the source while they were moved, each listed once.
+	// They were left on the source and taken back off the destination, so a deleted message is not delivered again,
+	// RenameQueue moves those still on the source on a later pass
+	NotMigrated []string
+	// Removed is set when the source queue was deleted after its messages were moved
+	Removed bool
+
+	notMigrated map[string]bool
+}
+
+// addNotMigrated lists the IDs in NotMigrated, those it already lists from an earlier pass are skipped
+func (r *MigrationReport) addNotMigrated(ids []string) {
+	if r.notMigrated == nil {
+		r.notMigrated = make(map[string]bool, len(ids))
+	}
+	for _, id := range ids {
+		if !r.notMigrated[id] {
+			r.notMigrated[id] = true
+			r.NotMigrated = append(r.NotMigrated, id)
+		}
+	}
+}
+
+// Verified is true when every message on the source was found on the destination
+func (r MigrationReport) Verified() bool {
+	return len(r.Missing) == 0
+}
+
+func (r MigrationReport) String() string {
+	marshal, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Sprintf("Could not marshal MigrationReport: %s", err)
+	}
+	return string(marshal)
+}
+
+// CopyNamespace copies queues, with their attributes, counters and messages, to the namespace of the Destination.
+// Queues which already exist in the destination keep their attributes, and messages they already hold are skipped,
+// so CopyNamespace can be run again to pick up messages sent since the last copy.
+// Each queue is verified after it is copied, messages missing from the destination are listed in its report.
+func (rsmq *RedisSMQ) CopyNamespace(ctx context.Context, options CopyNamespaceOptions) ([]*MigrationReport, error) {
+	dest := options.Destination
+	if dest == nil {
+		return nil, errors.New("CopyNamespace: Destination is nil")
+	}
+	qnames := options.QNames
+	if len(qnames) == 0 {
+		var err error
+		qnames, err = rsmq.ListQueues(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("CopyNamespace: %w", err)
+		}
+	}
+	same, err := rsmq.sameInstance(ctx, dest)
+	if err != nil {
+		return nil, fmt.Errorf("CopyNamespace: %w", err)
+	}
+	var reports []*MigrationReport
+	for _, qname := range qnames {
+		if same && rsmq.ns+":"+qname == dest.ns+":"+qname {
+			return reports, fmt.Errorf("CopyNamespace: %s would be copied onto itself", qname)
+		}
+		report := &MigrationReport{QName: qname, NewQName: qname}
+		if err := rsmq.copyQueue(ctx, dest, report, false); err != nil {
+			return reports, err
+		}
+		missing, err := rsmq.verifyQueue(ctx, dest, qname, qname)
+		if err != nil {
+			return reports, fmt.Errorf("CopyNamespace: verify %s: %w", qname, err)
+		}
+		report.Missing = missing
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// RenameQueue moves a queue, with its attributes, counters and messages, to NewQName in the Destination.
+// It is safe to run while producers are sending, switch them to the new queue first,
+// RenameQueue keeps moving messages until nothing is sending to QName and it is empty, waiting PollInterval between passes,
+// and returns the error of ctx when it is cancelled first.
+// Messages are moved in batches, each is verified on the destination before it is removed from QName,
+// and QName is deleted once it is empty, after which sending to it returns QueueNotFoundError.
+// Messages in flight keep their visibility timeout, they are delivered again if their consumer deletes them from QName.
+func (rsmq *RedisSMQ) RenameQueue(ctx context.Context, options RenameQueueOptions) (*MigrationReport, error) {
+	if len(options.QName) == 0 {
+		return nil, errors.New("RenameQueue: QName is empty")
+	}
+	dest := options.Destination
+	if dest == nil {
+		dest = rsmq
+	}
+	newQName := options.NewQName
+	if len(newQName) == 0 {
+		newQName = options.QName
+	}
+	key := rsmq.ns + ":" + options.QName
+	same, err := rsmq.sameInstance(ctx, dest)
+	if err != nil {
+		return nil, fmt.Errorf("RenameQueue: %w", err)
+	}
+	if same && key == dest.ns+":"+newQName {
+		return nil, fmt.Errorf("RenameQueue: %s would be moved onto itself", options.QName)
+	}
+	interval := options.PollInterval
+	if interval <= 0 {
+		interval = DefaultRenamePollInterval
+	}
+	report := &MigrationReport{QName: options.QName, NewQName: newQName}
+	// keep moving until the queue is empty, producers may still be sending to it
+	for {
+		if err := rsmq.copyQueue(ctx, dest, report, true); err != nil {
+			return report, err
+		}
+		removed, err := dropEmptyQueueScript.Run(ctx, rsmq.cl, []string{key, rsmq.ns + ":QUEUES", options.QName}).Int64()
+		if err != nil {
+			return report, fmt.Errorf("RenameQueue: delete %s: %w", options.QName, err)
+		}
+		if removed == 1 {
+			report.Removed = true
+			return report, nil
+		}
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sameInstance is true when dest stores its queues in the same redis database as this RedisSMQ.
+// The addresses of the clients can differ for the same database, e.g. localhost and 127.0.0.1,
+// so a nonce is written through this client and read back through the client of dest.
+func (rsmq *RedisSMQ) sameInstance(ctx context.Context, dest *RedisSMQ) (bool, error) {
+	if dest == rsmq {
+		return true, nil
+	}
+	key := rsmq.ns + ":NONCE:" + makeUID(22)
+	nonce := makeUID(22)
+	if err := rsmq.cl.Set(ctx, key, nonce, time.Minute).Err(); err != nil {
+		return false, fmt.Errorf("write nonce: %w", err)
+	}
+	defer rsmq.cl.Del(ctx, key)
+	got, err := dest.cl.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read nonce: %w", err)
+	}
+	return got == nonce, nil
+}
+
+// copyQueue copies the queue in report to dest, removing each batch of messages from the source when move is set
+func (rsmq *RedisSMQ) copyQueue(ctx context.Context, dest *RedisSMQ, report *MigrationReport, move bool) error {
+	key := rsmq.ns + ":" + report.QName
+	destKey := dest.ns + ":" + report.NewQName
+	attributes, err := rsmq.exportAttributes(ctx, key)
+	if errors.Is(err, QueueNotFoundError) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s: %w", report.QName, err)
+	}
+	if err := dest.importAttributes(ctx, report.NewQName, attributes, ImportPreserve); err != nil {
+		return fmt.Errorf("copy %s: %w", report.QName, err)
+	}
+	err = rsmq.scanMessages(ctx, key, func(batch []*ExportedMessage) error {
+		for _, m := range batch {
+			n, err := dest.importMessage(ctx, destKey, m, ImportPreserve, 0)
+			if err != nil {
+				return err
+			}
+			report.Copied += n
+		}
+		// only remove the batch from the source once it is known to be on the destination
+		missing, err := dest.missingMessages(ctx, destKey, batch)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%d messages were not found on %s after they were copied, the first is %s", len(missing), report.NewQName, missing[0])
+		}
+		if !move {
+			return nil
+		}
+		kept, err := rsmq.removeMessages(ctx, key, batch)
+		if err != nil {
+			return err
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		// messages which changed on the source since they were copied are taken back off the destination
+		isKept := make(map[string]bool, len(kept))
+		for _, id := range kept {
+			isKept[id] = true
+		}
+		changed := make([]*ExportedMessage, 0, len(kept))
+		for _, m := range batch {
+			if isKept[m.ID] {
+				changed = append(changed, m)
+			}
+		}
+		left, err := dest.removeMessages(ctx, destKey, changed)
+		if err != nil {
+			return err
+		}
+		report.Copied -= int64(len(changed) - len(left))
+		report.addNotMigrated(kept)
+		return nil
+	})
+	if errors.Is(err, QueueFullError) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s: %w", report.QName, err)
+	}
+	return nil
+}
+
+// removeMessages removes the messages in batch from the queue at key, each only while its score, rc and body are unchanged.
+// It returns the IDs of the messages which were not removed
+func (rsmq *RedisSMQ) removeMessages(ctx context.Context, key string, batch []*ExportedMessage) ([]string, error) {
+	args := []string{key}
+	for _, m := range batch {
+		args = append(args, m.ID, strconv.FormatInt(m.Score, 10), strconv.FormatInt(m.RC, 10), m.Body)
+	}
+	kept, err := removeMessagesScript.Run(ctx, rsmq.cl, args).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("remove messages: %w", err)
+	}
+	return kept, nil
+}
+
+// verifyQueue returns the IDs of messages on qname which are not on newQName in dest
+func (rsmq *RedisSMQ) verifyQueue(ctx context.Context, dest *RedisSMQ, qname string, newQName string) ([]string, error) {
+	var missing []string
+	err := rsmq.scanMessages(ctx, rsmq.ns+":"+qname, func(batch []*ExportedMessage) error {
+		m, err := dest.missingMessages(ctx, dest.ns+":"+newQName, batch)
+		missing = append(missing, m...)
+		return err
+	})
+	return missing, err
+}
+
+// missingMessages returns the IDs of messages in batch which are not on the queue at key with the same body
+func (rsmq *RedisSMQ) missingMessages(ctx context.Context, key string, batch []*ExportedMessage) ([]string, error) {
+	pipe := rsmq.cl.Pipeline()
+	scores := make([]*redis.FloatCmd, len(batch))
+	bodies := make([]*redis.StringCmd, len(batch))
+	for i, m := range batch {
+		scores[i] = pipe.ZScore(ctx, key, m.ID)
+		bodies[i] = pipe.HGet(ctx, key+":Q", m.ID)
+	}
+	// a message which is not on the queue fails with redis.Nil, which is checked per command below
+	_, _ = pipe.Exec(ctx)
+	var missing []string
+	for i, m := range batch {
+		if err := scores[i].Err(); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("verify: %w", err)
+		}
+		body, err := bodies[i].Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("verify: %w", err)
+		}
+		if scores[i].Err() != nil || err != nil || body != m.Body {
+			missing = append(missing, m.ID)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,252 @@
+package q
+
+import (
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"net"
+	"testing"
+)
+
+func TestCopyNamespace(t *testing.T) {
+	qName, q, ctx, err := newQ("TestCopyNamespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	ns := "copy" + makeUID(6)
+	dest, err := New(ctx, Options{Client: q.cl, NameSpace: &ns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "message"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName}); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := q.CopyNamespace(ctx, CopyNamespaceOptions{Destination: dest, QNames: []string{qName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Copied != 3 || !reports[0].Verified() {
+		t.Fatalf("expected 3 messages to be copied and verified but got %v", reports)
+	}
+	for _, id := range ids {
+		want, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dest.GetMessage(ctx, GetMessageOptions{QName: qName, ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("expected the copy to be %s but got %s", want, got)
+		}
+	}
+	attrs, err := dest.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.TotalSent != 3 || attrs.TotalReceived != 1 || attrs.HiddenMessages != 1 {
+		t.Fatalf("expected the counters to be copied but got %s", attrs)
+	}
+
+	// a message sent after the copy is reported missing, and copying again picks it up
+	late, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "late"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := q.verifyQueue(ctx, dest, qName, qName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != late {
+		t.Fatalf("expected %s to be missing but got %v", late, missing)
+	}
+	reports, err = q.CopyNamespace(ctx, CopyNamespaceOptions{Destination: dest, QNames: []string{qName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports[0].Copied != 1 || !reports[0].Verified() {
+		t.Fatalf("expected only the late message to be copied but got %s", reports[0])
+	}
+
+	_, err = q.CopyNamespace(ctx, CopyNamespaceOptions{Destination: q, QNames: []string{qName}})
+	if err == nil {
+		t.Fatal("expected copying a namespace onto itself to fail")
+	}
+}
+
+func TestRenameQueueOntoItself(t *testing.T) {
+	qName, q, ctx, err := newQ("TestRenameOntoItself")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	id, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "keep me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same redis through another address
+	opts := *q.cl.Options()
+	host, port, err := net.SplitHostPort(opts.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	} else if host == "127.0.0.1" {
+		host = "localhost"
+	}
+	opts.Addr = net.JoinHostPort(host, port)
+	other, err := New(ctx, Options{Client: redis.NewClient(&opts)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	_, err = q.RenameQueue(ctx, RenameQueueOptions{QName: qName, Destination: other})
+	if err == nil {
+		t.Fatal("expected renaming a queue onto itself through another address to fail")
+	}
+	_, err = q.CopyNamespace(ctx, CopyNamespaceOptions{Destination: other, QNames: []string{qName}})
+	if err == nil {
+		t.Fatal("expected copying a queue onto itself through another address to fail")
+	}
+	if _, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: id}); err != nil {
+		t.Fatalf("expected the message to be kept but got %v", err)
+	}
+}
+
+func TestRenameQueue(t *testing.T) {
+	qName, q, ctx, err := newQ("TestRenameQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newQName := qName + "Renamed"
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: newQName})
+	for i := 0; i < 250; i++ {
+		if _, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "before"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a producer which has not switched over yet keeps sending to the old name while it is moved
+	sent := make(chan []string)
+	go func() {
+		var ids []string
+		for i := 0; i < 200; i++ {
+			id, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "during"})
+			if errors.Is(err, QueueNotFoundError) {
+				sent <- ids
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				sent <- ids
+				return
+			}
+			ids = append(ids, id)
+		}
+		sent <- ids
+	}()
+	report, err := q.RenameQueue(ctx, RenameQueueOptions{QName: qName, NewQName: newQName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	during := <-sent
+	if !report.Removed {
+		t.Fatalf("expected %s to be removed but got %s", qName, report)
+	}
+	if report.Copied != int64(250+len(during)) {
+		t.Fatalf("expected %d messages to be moved but got %s", 250+len(during), report)
+	}
+	for _, id := range during {
+		if _, err := q.GetMessage(ctx, GetMessageOptions{QName: newQName, ID: id}); err != nil {
+			t.Fatalf("expected %s sent during the rename to be moved: %s", id, err)
+		}
+	}
+	attrs, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: newQName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.CurrentN != report.Copied {
+		t.Fatalf("expected %d messages on %s but got %s", report.Copied, newQName, attrs)
+	}
+	queues, err := q.ListQueues(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range queues {
+		if name == qName {
+			t.Fatalf("expected %s to be deleted", qName)
+		}
+	}
+}
+
+func TestRemoveMessagesKeepsChanged(t *testing.T) {
+	qName, q, ctx, err := newQ("TestRemoveChanged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "message"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	key := q.ns + ":" + qName
+	var batch []*ExportedMessage
+	err = q.scanMessages(ctx, key, func(b []*ExportedMessage) error {
+		batch = append(batch, b...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after the copy one message is received and another deleted
+	received, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil || received == nil {
+		t.Fatalf("expected to receive a message but got %s %v", received, err)
+	}
+	var deleted string
+	for _, id := range ids {
+		if id != received.ID {
+			deleted = id
+			break
+		}
+	}
+	if err := q.DeleteMessage(ctx, DeleteMessageRequest{QName: qName, ID: deleted}); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, err := q.removeMessages(ctx, key, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 {
+		t.Fatalf("expected the received and deleted messages to be kept but got %v", kept)
+	}
+	if _, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: received.ID}); err != nil {
+		t.Fatalf("expected the received message to stay on the queue but got %v", err)
+	}
+	attrs, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.CurrentN != 1 {
+		t.Fatalf("expected only the received message to be left but got %s", attrs)
+	}
+}
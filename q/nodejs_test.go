@@ -0,0 +1,245 @@
+package q
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var nodePeerDir = filepath.Join("..", "contrib", "nodejs_peer")
+
+// nodeMessage is a message as returned by receiveMessage in the nodejs implementation
+type nodeMessage struct {
+	ID      string  `json:"id"`
+	Message string  `json:"message"`
+	RC      int64   `json:"rc"`
+	FR      int64   `json:"fr"`
+	Sent    float64 `json:"sent"`
+}
+
+// nodeAttributeNames are the fields returned by getQueueAttributes in the nodejs implementation
+var nodeAttributeNames = []string{"vt", "delay", "maxsize", "totalrecv", "totalsent", "created", "modified", "msgs", "hiddenmsgs"}
+
+// nodePeer calls method on the nodejs implementation through contrib/nodejs_peer/peer.js and decodes the response into v.
+// The test is skipped when node or the peer's dependencies are not installed
+func nodePeer(t *testing.T, method string, options interface{}, v interface{}) {
+	t.Helper()
+	if _, err := exec.LookPath("node"); err != nil {
+		t.Skip("node is not installed")
+	}
+	if _, err := os.Stat(filepath.Join(nodePeerDir, "node_modules", "rsmq")); err != nil {
+		t.Skip("run npm install in contrib/nodejs_peer to test against the nodejs implementation")
+	}
+	opts, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("node", "peer.js", method, string(opts))
+	cmd.Dir = nodePeerDir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("node peer %s: %s", method, err)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		t.Fatalf("node peer %s returned %q: %s", method, out, err)
+	}
+}
+
+// checkNodeAttributes compares the attributes reported by both implementations
+func checkNodeAttributes(t *testing.T, rsmq *RedisSMQ, qname string) {
+	t.Helper()
+	var node map[string]int64
+	nodePeer(t, "getQueueAttributes", map[string]string{"qname": qname}, &node)
+	for _, name := range nodeAttributeNames {
+		if _, ok := node[name]; !ok {
+			t.Fatalf("expected the nodejs attributes to include %s but got %v", name, node)
+		}
+	}
+	attrs, err := rsmq.GetQueueAttributes(context.Background(), GetQueueAttributesOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, _ := strconv.ParseInt(attrs.Created, 10, 64)
+	modified, _ := strconv.ParseInt(attrs.Modified, 10, 64)
+	want := map[string]int64{
+		"vt":         int64(attrs.VisibilityTimeout),
+		"delay":      int64(attrs.DelayForMessages),
+		"maxsize":    attrs.MaxSizeBytes,
+		"totalrecv":  attrs.TotalReceived,
+		"totalsent":  attrs.TotalSent,
+		"created":    created,
+		"modified":   modified,
+		"msgs":       attrs.CurrentN,
+		"hiddenmsgs": attrs.HiddenMessages,
+	}
+	for name, v := range want {
+		if node[name] != v {
+			t.Fatalf("expected %s to be %d in both implementations but nodejs reported %d", name, v, node[name])
+		}
+	}
+}
+
+func TestNodeReceivesGoMessage(t *testing.T) {
+	qname, rsmq, ctx, err := newQ("nodeReceive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsmq.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qname})
+
+	id, err := rsmq.SendMessage(ctx, SendMessageRequestOptions{QName: qname, Message: "from go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received nodeMessage
+	nodePeer(t, "receiveMessage", map[string]string{"qname": qname}, &received)
+	if received.ID != id || received.Message != "from go" || received.RC != 1 {
+		t.Fatalf("expected nodejs to receive %s once but got %+v", id, received)
+	}
+	msg, err := rsmq.GetMessage(ctx, GetMessageOptions{QName: qname, ID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.RC != 1 || msg.FR.UnixMilli() != received.FR {
+		t.Fatalf("expected rc 1 and fr %d but got %s", received.FR, msg)
+	}
+	if msg.Sent.UnixMilli() != int64(received.Sent) {
+		t.Fatalf("expected the sent time %v but nodejs reported %v", msg.Sent.UnixMilli(), received.Sent)
+	}
+	checkNodeAttributes(t, rsmq, qname)
+}
+
+func TestGoReceivesNodeMessage(t *testing.T) {
+	qname, rsmq, ctx, err := newQ("goReceive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsmq.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qname})
+
+	var id string
+	nodePeer(t, "sendMessage", map[string]string{"qname": qname, "message": "from node"}, &id)
+	msg, err := rsmq.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil || msg.ID != id || msg.Message != "from node" || msg.RC != 1 {
+		t.Fatalf("expected to receive %s once but got %s", id, msg)
+	}
+	if time.Since(msg.Sent) > time.Minute || time.Since(msg.Sent) < -time.Minute {
+		t.Fatalf("expected the sent time of %s to be now but got %s", id, msg.Sent)
+	}
+
+	// make it visible again, nodejs sees the receive count and first receive time go recorded
+	_, err = rsmq.ChangeMessageVisibility(ctx, ChangeMessageVisibilityOptions{QName: qname, ID: id, VisibilityTimeout: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received nodeMessage
+	nodePeer(t, "receiveMessage", map[string]string{"qname": qname}, &received)
+	if received.ID != id || received.RC != 2 || received.FR != msg.FR.UnixMilli() {
+		t.Fatalf("expected nodejs to receive %s a second time with fr %d but got %+v", id, msg.FR.UnixMilli(), received)
+	}
+	checkNodeAttributes(t, rsmq, qname)
+
+	var deleted int
+	nodePeer(t, "deleteMessage", map[string]string{"qname": qname, "id": id}, &deleted)
+	if deleted != 1 {
+		t.Fatalf("expected nodejs to delete %s", id)
+	}
+	attrs, err := rsmq.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.CurrentN != 0 || attrs.TotalSent != 1 || attrs.TotalReceived != 2 {
+		t.Fatalf("expected an empty queue with one send and two receives but got %s", attrs)
+	}
+}
+
+func TestNodeCreatesQueue(t *testing.T) {
+	other, rsmq, ctx, err := newQ("nodeCreate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsmq.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: other})
+	qname := "nodeCreated" + makeUID(4)
+	var created int
+	nodePeer(t, "createQueue", map[string]interface{}{"qname": qname, "vt": 45, "delay": 2}, &created)
+	defer rsmq.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qname})
+	if created != 1 {
+		t.Fatalf("expected nodejs to create %s", qname)
+	}
+	queues, err := rsmq.ListQueues(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range queues {
+		found = found || name == qname
+	}
+	if !found {
+		t.Fatalf("expected %s in %v", qname, queues)
+	}
+	attrs, err := rsmq.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.VisibilityTimeout != 45 || attrs.DelayForMessages != 2 {
+		t.Fatalf("expected vt 45 and delay 2 but got %s", attrs)
+	}
+	checkNodeAttributes(t, rsmq, qname)
+}
+
+func TestNodeQueueDelay(t *testing.T) {
+	qname, rsmq, ctx, err := newQ("nodeDelay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsmq.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qname})
+	// the delay is in seconds in both implementations
+	delay := 1
+	_, err = rsmq.SetQueueAttributes(ctx, SetAttributesOptions{QName: qname, DelayForMessages: &delay})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// go sends with the queue delay, nodejs sees the message once it passes
+	id, err := rsmq.SendMessage(ctx, SendMessageRequestOptions{QName: qname, Message: "from go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received nodeMessage
+	nodePeer(t, "receiveMessage", map[string]string{"qname": qname}, &received)
+	if received.ID != "" {
+		t.Fatalf("expected nodejs to see %s as delayed but received %+v", id, received)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	nodePeer(t, "receiveMessage", map[string]string{"qname": qname}, &received)
+	if received.ID != id {
+		t.Fatalf("expected nodejs to receive %s once the delay passed but got %+v", id, received)
+	}
+
+	// nodejs sends with the queue delay, go sees the message once it passes
+	var nodeID string
+	nodePeer(t, "sendMessage", map[string]string{"qname": qname, "message": "from node"}, &nodeID)
+	msg, err := rsmq.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != nil {
+		t.Fatalf("expected %s to be delayed but received %s", nodeID, msg)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	msg, err = rsmq.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil || msg.ID != nodeID {
+		t.Fatalf("expected to receive %s once the delay passed but got %s", nodeID, msg)
+	}
+	checkNodeAttributes(t, rsmq, qname)
+}
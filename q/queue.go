@@ -0,0 +1,21 @@
+package q
+
+import "context"
+
+// Queue is the set of operations applications use to work with queues.
+// Depend on Queue rather than *RedisSMQ so a different implementation can be substituted, e.g. in unit tests.
+type Queue interface {
+	CreateQueue(ctx context.Context, opts CreateQueueRequestOptions) error
+	ListQueues(ctx context.Context) ([]string, error)
+	DeleteQueue(ctx context.Context, options DeleteQueueRequestOptions) error
+	GetQueueAttributes(ctx context.Context, opts GetQueueAttributesOptions) (*QueueAttributes, error)
+	SetQueueAttributes(ctx context.Context, options SetAttributesOptions) (*QueueAttributes, error)
+	SendMessage(ctx context.Context, opts SendMessageRequestOptions) (string, error)
+	ReceiveMessage(ctx context.Context, opts ReceiveMessageOptions) (*Message, error)
+	PopMessage(ctx context.Context, options PopMessageOptions) (*Message, error)
+	DeleteMessage(ctx context.Context, options DeleteMessageRequest) error
+	ChangeMessageVisibility(ctx context.Context, options ChangeMessageVisibilityOptions) (bool, error)
+	Close() error
+}
+
+var _ Queue = (*RedisSMQ)(nil)
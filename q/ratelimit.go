@@ -0,0 +1,37 @@
+package q
+
+import (
+	"math"
+	"time"
+)
+
+// TokenBucket is the receive rate limit of a queue for Queue implementations which keep it outside redis,
+// it follows the same rules as the bucket RedisSMQ keeps in scriptRateLimit.
+// The bucket holds up to rate tokens and refills at rate tokens per second, a receive takes one token.
+type TokenBucket struct {
+	Tokens float64
+	// At is the unix millisecond time Tokens was counted
+	At int64
+	// Expire is the unix millisecond time after which the bucket is full again
+	Expire int64
+}
+
+// Available returns the tokens in the bucket at now for a limit of rate receives per second,
+// or a RateLimitError when there is not a whole token. It returns rate when there is no limit
+func (b TokenBucket) Available(rate int, now int64) (float64, error) {
+	r := float64(rate)
+	if rate <= 0 || now >= b.Expire {
+		return r, nil
+	}
+	tokens := math.Min(r, b.Tokens+float64(now-b.At)*r/1000)
+	if tokens < 1 {
+		retryAfter := math.Ceil((1 - tokens) * 1000 / r)
+		return tokens, &RateLimitError{RetryAfter: time.Duration(retryAfter) * time.Millisecond}
+	}
+	return tokens, nil
+}
+
+// Take records a receive at now, which used one of the tokens returned by Available
+func (b *TokenBucket) Take(tokens float64, now int64) {
+	b.Tokens, b.At, b.Expire = tokens-1, now, now+1000
+}
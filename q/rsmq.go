@@ -2,18 +2,57 @@ package q
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
-	"log"
-	"math/big"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var QueueNotFoundError = errors.New("Queue Not Found")
+var MessageNotFoundError = errors.New("Message Not Found")
+
+// QueueFullError is returned when sending or moving a message would exceed the queue MaxMessages or MaxBytes
+var QueueFullError = errors.New("Queue Full")
+
+// RateLimitError is returned by ReceiveMessage and PopMessage when the queue MaxReceivesPerSecond is used up
+type RateLimitError struct {
+	// RetryAfter is how long until the next receive is allowed
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Receive Rate Limited, retry after %s", e.RetryAfter)
+}
+
+// MessageState describes whether a message can currently be received
+type MessageState string
+
+const (
+	// MessageDelayed has been sent but not yet become visible for the first time
+	MessageDelayed MessageState = "delayed"
+	// MessageVisible can be received right now
+	MessageVisible MessageState = "visible"
+	// MessageInFlight has been received and is hidden until its visibility timeout passes
+	MessageInFlight MessageState = "in-flight"
+)
+
+func messageState(score int64, rc int64, now time.Time) MessageState {
+	if score <= now.UnixMilli() {
+		return MessageVisible
+	}
+	if rc > 0 {
+		return MessageInFlight
+	}
+	return MessageDelayed
+}
 
 type Message struct {
 	// ID is the internal message identifier
@@ -29,6 +68,30 @@ type Message struct {
 
 	// Deadline is the time that this message Must be processed by, or nil if no deadline
 	Deadline *time.Time
+	// State is only reported by GetMessage and PeekMessages
+	State MessageState `json:",omitempty"`
+	// Metadata is carried alongside the message body, it holds the trace context when tracing is enabled
+	Metadata map[string]string `json:",omitempty"`
+	// Cursor is the position of the message on the queue, it is only set by PeekMessages and GetMessage.
+	// Pass it as PeekMessagesOptions.After to peek at the messages after this one
+	Cursor string `json:",omitempty"`
+}
+
+// messageCursor is the Cursor of message id with the given score, messages are ordered by score and then by ID
+func messageCursor(score int64, id string) string {
+	return strconv.FormatInt(score, 10) + ":" + id
+}
+
+// parseMessageCursor returns the score and ID of a Cursor
+func parseMessageCursor(cursor string) (string, string, error) {
+	score, id, ok := strings.Cut(cursor, ":")
+	if !ok || len(id) == 0 {
+		return "", "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	if _, err := strconv.ParseInt(score, 10, 64); err != nil {
+		return "", "", fmt.Errorf("invalid cursor %q: %w", cursor, err)
+	}
+	return score, id, nil
 }
 
 func (m Message) String() string {
@@ -51,13 +114,30 @@ type GetQueueAttributesOptions struct {
 type DeleteQueueRequestOptions struct {
 	QName string
 }
+type PurgeQueueOptions struct {
+	QName string
+}
 
 type SendMessageRequestOptions struct {
-	QName   string
+	QName string
+	// Delay is the seconds until the message is visible, counted from the redis server time.
+	// It replaces the queue delay when it is greater than 0, as it does for the nodejs implementation
 	Delay   int
 	Message string
+	// DeliverAt is the absolute time the message becomes visible, overriding the queue delay when set.
+	// Times in the past are delivered immediately.
+	DeliverAt time.Time
+	// TTL in seconds, after which the message expires even if it was never received.
+	// The queue MessageRetentionSeconds applies when it is shorter.
+	TTL int
+	// Metadata is stored alongside the message and returned on receive
+	Metadata map[string]string
 }
 
+// MaxExpiresPerReceive is the most expired messages a receive or pop removes before it returns no message,
+// so a backlog of expired messages can not stall the queue. The rest are removed by later receives or ExpireMessages.
+const MaxExpiresPerReceive = 100
+
 type ChangeMessageVisibilityOptions struct {
 	QName             string
 	ID                string
@@ -69,16 +149,70 @@ type DeleteMessageRequest struct {
 	ID    string
 }
 
+type MoveMessageOptions struct {
+	// From is the queue the message is currently on
+	From string
+	// To is the queue the message is moved to
+	To string
+	ID string
+	// Copy leaves the message on From and sends a new message with the same body to To, which expires when the original does
+	Copy bool
+}
+
+type MoveMessagesOptions struct {
+	From string
+	To   string
+	// Filter selects the messages to move by their body, all messages are moved when nil
+	Filter func(body string) bool
+	Copy   bool
+}
+
+type RescheduleMessageOptions struct {
+	QName string
+	ID    string
+	// At is the absolute time the message becomes visible
+	At time.Time
+}
+
+type CancelScheduledMessageOptions struct {
+	QName string
+	ID    string
+}
+
+type ExpireMessagesOptions struct {
+	QName string
+}
+
+// QueueAttributes VisibilityTimeout and DelayForMessages are in seconds, as they are for the nodejs implementation
 type QueueAttributes struct {
-	VisibilityTimeout int    `redis:"vt"`
-	DelayForMessages  int    `redis:"delay"`
-	MaxSizeBytes      int64  `redis:"maxsize"`
-	TotalReceived     int64  `redis:"totalrecv"`
-	TotalSent         int64  `redis:"totalsent"`
-	Created           string `redis:"created"`
-	Modified          string `redis:"modified"`
-	CurrentN          int64
-	HiddenMessages    int64
+	VisibilityTimeout int   `redis:"vt"`
+	DelayForMessages  int   `redis:"delay"`
+	MaxSizeBytes      int64 `redis:"maxsize"`
+	TotalReceived     int64 `redis:"totalrecv"`
+	TotalSent         int64 `redis:"totalsent"`
+	// Created and Modified are unix seconds, as they are for the nodejs implementation.
+	// Queues created by older versions hold an RFC3339 time instead, and a delay in milliseconds, until UpgradeQueues converts them
+	Created  string `redis:"created"`
+	Modified string `redis:"modified"`
+	// MessageRetentionSeconds is how long a message is kept after it is sent, or 0 to keep it forever.
+	// The expiry is worked out when a message is sent, so changing it leaves the messages already on the queue as they were
+	MessageRetentionSeconds int `redis:"retention"`
+	// DeadLetterQueue receives expired messages instead of them being dropped, when set
+	DeadLetterQueue string `redis:"dlq"`
+	// DeadLetterDropped counts expired messages which were dropped because the DeadLetterQueue was full
+	DeadLetterDropped int64 `redis:"dlqdropped"`
+	// MaxReceivesPerSecond limits receives across every consumer of the queue, or 0 for no limit
+	MaxReceivesPerSecond int `redis:"maxrecvrate"`
+	// MaxMessages is the most messages the queue holds before SendMessage returns QueueFullError, or 0 for no limit
+	MaxMessages int64 `redis:"maxmsgs"`
+	// MaxBytes is the most message bytes the queue holds before SendMessage returns QueueFullError, or 0 for no limit
+	MaxBytes int64 `redis:"maxbytes"`
+	// CurrentBytes is the total size of the message bodies on the queue
+	CurrentBytes int64 `redis:"bytes"`
+	// Paused queues return no messages on receive or pop, sends still succeed
+	Paused         bool `redis:"paused"`
+	CurrentN       int64
+	HiddenMessages int64
 }
 
 func (q QueueAttributes) String() string {
@@ -89,14 +223,43 @@ func (q QueueAttributes) String() string {
 	return string(marshal)
 }
 
+type PauseQueueOptions struct {
+	QName string
+}
+
+type ResumeQueueOptions struct {
+	QName string
+}
+
 type PopMessageOptions struct {
 	QName string
 }
 
+type GetMessageOptions struct {
+	QName string
+	ID    string
+}
+
+type PeekMessagesOptions struct {
+	QName string
+	// IncludeHidden also returns delayed and in-flight messages, with Deadline set to when they become visible
+	IncludeHidden bool
+	// Offset is the number of messages to skip, messages are ordered by the time they become visible
+	Offset int64
+	// After is the Cursor of the last message of an earlier peek, only the messages ordered after it are returned.
+	// Unlike Offset it does not skip or repeat messages when the queue changes between peeks
+	After string
+	// Limit is the maximum number of messages returned, defaults to 10
+	Limit int64
+}
+
 type qAttr struct {
-	VisibilityTimeout int   `redis:"vt"`
-	DelayForMessages  int   `redis:"delay"`
-	MaxSizeBytes      int64 `redis:"maxsize"`
+	VisibilityTimeout int    `redis:"vt"`
+	DelayForMessages  int    `redis:"delay"`
+	MaxSizeBytes      int64  `redis:"maxsize"`
+	Retention         int    `redis:"retention"`
+	DeadLetterQueue   string `redis:"dlq"`
+	MaxReceiveRate    int    `redis:"maxrecvrate"`
 	TimeSent          time.Time
 	UID               string
 }
@@ -113,12 +276,26 @@ func (q qAttr) timeVisibilityExpiresUnix(overrideVT *int) string {
 	return strconv.FormatInt(newVisibilityTimeout, 10)
 }
 
+// expiresUnix is when a message sent now expires, or 0 when neither the ttl or the queue retention apply
+func (q qAttr) expiresUnix(ttl int) int64 {
+	return ExpiresUnix(q.TimeSent, q.Retention, ttl)
+}
+
+// deliverAtUnix is the score for a message which becomes visible at the given time,
+// times before the redis server time are clamped so that they are delivered in order with other visible messages
+func (q qAttr) deliverAtUnix(at time.Time) int64 {
+	if at.Before(q.TimeSent) {
+		return q.TimeSent.UnixMilli()
+	}
+	return at.UnixMilli()
+}
+
 type RedisSMQ struct {
-	cl                 *redis.Client
-	popMessageSha1     *string
-	receiveMessageSha1 *string
-	hideMessageSha1    *string
-	ns                 string
+	cl           *redis.Client
+	ns           string
+	tracer       trace.Tracer
+	propagator   propagation.TextMapPropagator
+	interceptors []Interceptor
 }
 
 func (rsmq *RedisSMQ) CreateQueue(ctx context.Context, opts CreateQueueRequestOptions) error {
@@ -137,8 +314,8 @@ func (rsmq *RedisSMQ) CreateQueue(ctx context.Context, opts CreateQueueRequestOp
 		"vt":        30, // TODO allow this to be set with CreateQueueRequestOptions
 		"delay":     0,
 		"maxsize":   65536,
-		"created":   result,
-		"modified":  result,
+		"created":   result.Unix(),
+		"modified":  result.Unix(),
 	}).Result()
 	if err != nil {
 		return fmt.Errorf("CreateQueue: set queue params: %w", err)
@@ -153,6 +330,19 @@ func (rsmq *RedisSMQ) CreateQueue(ctx context.Context, opts CreateQueueRequestOp
 // ReceiveMessage receives the next message from the queue, re-entering the queue if it is not received elsewhere
 // A received message is invisible to other consumers for an amount of time
 func (rsmq *RedisSMQ) ReceiveMessage(ctx context.Context, opts ReceiveMessageOptions) (*Message, error) {
+	call := &Call{Method: "ReceiveMessage", QName: opts.QName, Options: opts}
+	res, err := rsmq.intercept(ctx, call, func(ctx context.Context, call *Call) (interface{}, error) {
+		opts, ok := call.Options.(ReceiveMessageOptions)
+		if !ok {
+			return nil, invalidCallOptions(call)
+		}
+		return rsmq.receiveMessage(ctx, opts)
+	})
+	msg, _ := res.(*Message)
+	return msg, err
+}
+
+func (rsmq *RedisSMQ) receiveMessage(ctx context.Context, opts ReceiveMessageOptions) (*Message, error) {
 	key := rsmq.ns + ":" + opts.QName
 	q, err := rsmq.getQueue(ctx, opts.QName)
 	if err != nil {
@@ -161,11 +351,7 @@ func (rsmq *RedisSMQ) ReceiveMessage(ctx context.Context, opts ReceiveMessageOpt
 
 	timeSentUnix := q.timeSentUnix()
 	timeVisibilityExpiresUnix := q.timeVisibilityExpiresUnix(opts.VisibilityTimeout)
-	// TODO -- potential panic if messageSHA1 is nil
-	results, err := rsmq.cl.EvalSha(
-		ctx,
-		*rsmq.receiveMessageSha1,
-		[]string{key, timeSentUnix, timeVisibilityExpiresUnix}).Slice()
+	results, err := receiveMessageScript.Run(ctx, rsmq.cl, []string{key, timeSentUnix, timeVisibilityExpiresUnix, rsmq.deadLetterKey(q), strconv.Itoa(q.MaxReceiveRate)}).Slice()
 	if err != nil {
 		return nil, fmt.Errorf("recieve message: eval recieveMessage script: %w", err)
 	}
@@ -178,7 +364,7 @@ func (rsmq *RedisSMQ) getQueue(ctx context.Context, name string) (*qAttr, error)
 	pipe := rsmq.cl.Pipeline()
 	t := pipe.Time(ctx)
 
-	attr := pipe.HMGet(ctx, key, "vt", "delay", "maxsize")
+	attr := pipe.HMGet(ctx, key, "vt", "delay", "maxsize", "retention", "dlq", "maxrecvrate")
 	_, err := pipe.Exec(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getQ %s: %w", key, err)
@@ -195,12 +381,49 @@ func (rsmq *RedisSMQ) getQueue(ctx context.Context, name string) (*qAttr, error)
 	}
 
 	q.TimeSent = t.Val()
-	q.UID = makeUID(22)
+	q.UID = MakeMessageID(q.TimeSent)
 
 	return &q, nil
 }
 
+// deadLetterKey is the key of the queue expired messages are routed to, or empty if they are dropped
+func (rsmq *RedisSMQ) deadLetterKey(q *qAttr) string {
+	if len(q.DeadLetterQueue) == 0 {
+		return ""
+	}
+	return rsmq.ns + ":" + q.DeadLetterQueue
+}
+
+// SendMessage sends a message to the queue, returning its ID.
+// When tracing is enabled the trace context of the send span is injected into the message Metadata.
 func (rsmq *RedisSMQ) SendMessage(ctx context.Context, opts SendMessageRequestOptions) (string, error) {
+	call := &Call{Method: "SendMessage", QName: opts.QName, Options: opts}
+	res, err := rsmq.intercept(ctx, call, func(ctx context.Context, call *Call) (interface{}, error) {
+		opts, ok := call.Options.(SendMessageRequestOptions)
+		if !ok {
+			return nil, invalidCallOptions(call)
+		}
+		return rsmq.sendMessage(ctx, opts)
+	})
+	uid, _ := res.(string)
+	return uid, err
+}
+
+func (rsmq *RedisSMQ) sendMessage(ctx context.Context, opts SendMessageRequestOptions) (string, error) {
+	ctx, span := rsmq.startSendSpan(ctx, opts.QName)
+	defer span.End()
+	opts.Metadata = rsmq.injectMetadata(ctx, opts.Metadata)
+	uid, err := rsmq.writeMessage(ctx, opts)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+	span.SetAttributes(attribute.String("messaging.message_id", uid))
+	return uid, nil
+}
+
+func (rsmq *RedisSMQ) writeMessage(ctx context.Context, opts SendMessageRequestOptions) (string, error) {
 	key := rsmq.ns + ":" + opts.QName
 	q, err := rsmq.getQueue(ctx, opts.QName)
 	if err != nil {
@@ -209,19 +432,41 @@ func (rsmq *RedisSMQ) SendMessage(ctx context.Context, opts SendMessageRequestOp
 	if int64(len(opts.Message)) > q.MaxSizeBytes {
 		return "", errors.New("Message is larger than allowed max size: " + strconv.FormatInt(q.MaxSizeBytes, 10))
 	}
-	pipe := rsmq.cl.Pipeline()
-	sendTime := time.Duration(q.DelayForMessages) * time.Millisecond
-	pipe.ZAdd(ctx, key, &redis.Z{
-		Score:  float64(q.TimeSent.Add(sendTime).UnixMilli()),
-		Member: q.UID,
-	})
-	pipe.HSet(ctx, key+":Q", q.UID, opts.Message)
-	pipe.HIncrBy(ctx, key+":Q", "totalsent", 1)
+	// the queue delay is in seconds, as it is for the nodejs implementation
+	delay := q.DelayForMessages
+	if opts.Delay > 0 {
+		delay = opts.Delay
+	}
+	sendTime := time.Duration(delay) * time.Second
+	score := q.TimeSent.Add(sendTime).UnixMilli()
+	if !opts.DeliverAt.IsZero() {
+		score = q.deliverAtUnix(opts.DeliverAt)
+	}
+	var expires, meta string
+	if exp := q.expiresUnix(opts.TTL); exp > 0 {
+		expires = strconv.FormatInt(exp, 10)
+	}
+	if len(opts.Metadata) > 0 {
+		b, err := json.Marshal(opts.Metadata)
+		if err != nil {
+			return "", fmt.Errorf("sending message to Q: marshal metadata: %w", err)
+		}
+		meta = string(b)
+	}
+	// the script checks the queue capacity and writes the message atomically, so a crash can never leave it half sent
+	args := []string{key, q.UID, strconv.FormatInt(score, 10), opts.Message, expires, meta, q.timeSentUnix()}
 	// TODO if realtime Q then run 'zcard key'
-	_, err = pipe.Exec(ctx)
+	sent, err := sendMessageScript.Run(ctx, rsmq.cl, args).Int64()
 	if err != nil {
 		return "", fmt.Errorf("sending message to Q: %w", err)
 	}
+	if sent == 0 {
+		return "", QueueFullError
+	}
+	if sent < 0 {
+		// the queue was deleted after getQueue
+		return "", QueueNotFoundError
+	}
 
 	return q.UID, nil
 }
@@ -234,11 +479,12 @@ func (rsmq *RedisSMQ) GetQueueAttributes(ctx context.Context, opts GetQueueAttri
 	}
 
 	pipe := rsmq.cl.Pipeline()
-	fields := []string{"vt", "delay", "maxsize", "totalrecv", "totalsent", "created", "modified"}
+	fields := []string{"vt", "delay", "maxsize", "totalrecv", "totalsent", "created", "modified", "retention", "dlq", "maxrecvrate",
+		"maxmsgs", "maxbytes", "bytes", "paused", "dlqdropped"}
 	queueAttrs := pipe.HMGet(ctx, rsmq.ns+":"+opts.QName+":Q", fields...)
 
 	count := pipe.ZCard(ctx, key)
-	// TODO validate this is right level or do we need UnixMilli/UnixNano
+	// messages scored at the current millisecond are counted as hidden, as they are by the nodejs implementation
 	zcount := pipe.ZCount(ctx, key, fmt.Sprint(t.UnixMilli()), "+inf")
 
 	_, err = pipe.Exec(ctx)
@@ -266,9 +512,9 @@ func (rsmq *RedisSMQ) DeleteQueue(ctx context.Context, options DeleteQueueReques
 		return errors.New("QName is empty")
 	}
 	key := rsmq.ns + ":" + options.QName
-	pipe := rsmq.cl.Pipeline()
+	pipe := rsmq.cl.TxPipeline()
 
-	pipe.Del(ctx, key)
+	pipe.Del(ctx, key, key+":Q", key+":RL")
 	pipe.SRem(ctx, rsmq.ns+":QUEUES", options.QName)
 	_, err := pipe.Exec(ctx)
 	if err != nil {
@@ -277,15 +523,83 @@ func (rsmq *RedisSMQ) DeleteQueue(ctx context.Context, options DeleteQueueReques
 	return nil
 }
 
+// PauseQueue stops ReceiveMessage and PopMessage returning messages from the queue until ResumeQueue is called.
+// Messages can still be sent, and messages already in flight can still be deleted or have their visibility changed.
+func (rsmq *RedisSMQ) PauseQueue(ctx context.Context, options PauseQueueOptions) error {
+	return rsmq.setPaused(ctx, options.QName, true)
+}
+
+// ResumeQueue lets a paused queue be received from again
+func (rsmq *RedisSMQ) ResumeQueue(ctx context.Context, options ResumeQueueOptions) error {
+	return rsmq.setPaused(ctx, options.QName, false)
+}
+
+func (rsmq *RedisSMQ) setPaused(ctx context.Context, qname string, paused bool) error {
+	if len(qname) == 0 {
+		return errors.New("QName is empty")
+	}
+	_, err := rsmq.getQueue(ctx, qname)
+	if err != nil {
+		return err
+	}
+	t, err := rsmq.cl.Time(ctx).Result()
+	if err != nil {
+		return fmt.Errorf("setPaused: %w", err)
+	}
+	key := rsmq.ns + ":" + qname + ":Q"
+	pipe := rsmq.cl.TxPipeline()
+	if paused {
+		pipe.HSet(ctx, key, "paused", 1)
+	} else {
+		pipe.HDel(ctx, key, "paused")
+	}
+	pipe.HSet(ctx, key, "modified", t.Unix())
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("setPaused: %w", err)
+	}
+	return nil
+}
+
+// PurgeQueue atomically deletes every message on the queue, keeping the queue attributes and counters.
+// It returns the number of messages removed.
+func (rsmq *RedisSMQ) PurgeQueue(ctx context.Context, options PurgeQueueOptions) (int64, error) {
+	if len(options.QName) == 0 {
+		return 0, errors.New("QName is empty")
+	}
+	_, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := purgeQueueScript.Run(ctx, rsmq.cl, []string{rsmq.ns + ":" + options.QName}).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("PurgeQueue: %w", err)
+	}
+	return n, nil
+}
+
 func (rsmq *RedisSMQ) DeleteMessage(ctx context.Context, options DeleteMessageRequest) error {
+	call := &Call{Method: "DeleteMessage", QName: options.QName, Options: options}
+	_, err := rsmq.intercept(ctx, call, func(ctx context.Context, call *Call) (interface{}, error) {
+		options, ok := call.Options.(DeleteMessageRequest)
+		if !ok {
+			return nil, invalidCallOptions(call)
+		}
+		return nil, rsmq.deleteMessage(ctx, options)
+	})
+	return err
+}
+
+func (rsmq *RedisSMQ) deleteMessage(ctx context.Context, options DeleteMessageRequest) error {
 	if len(options.QName) == 0 || len(options.ID) == 0 {
 		return errors.New("options.QNAME or options.ID was empty but it should not be empty")
 	}
-	key := rsmq.ns + ":" + options.QName
-	pipe := rsmq.cl.Pipeline()
-	pipe.ZRem(ctx, key, options.ID)
-	pipe.HDel(ctx, key+":Q", options.ID+":rc", options.ID+":fr")
-	_, err := pipe.Exec(ctx)
+	t, err := rsmq.cl.Time(ctx).Result()
+	if err != nil {
+		return fmt.Errorf("deleteMessage: %w", err)
+	}
+	args := []string{rsmq.ns + ":" + options.QName, options.ID, strconv.FormatInt(t.UnixMilli(), 10)}
+	err = deleteMessageScript.Run(ctx, rsmq.cl, args).Err()
 	if err != nil {
 		return fmt.Errorf("deleteMessage: %w", err)
 	}
@@ -294,6 +608,19 @@ func (rsmq *RedisSMQ) DeleteMessage(ctx context.Context, options DeleteMessageRe
 
 // ChangeMessageVisibility will update the time when a message will be hidden.
 func (rsmq *RedisSMQ) ChangeMessageVisibility(ctx context.Context, options ChangeMessageVisibilityOptions) (bool, error) {
+	call := &Call{Method: "ChangeMessageVisibility", QName: options.QName, Options: options}
+	res, err := rsmq.intercept(ctx, call, func(ctx context.Context, call *Call) (interface{}, error) {
+		options, ok := call.Options.(ChangeMessageVisibilityOptions)
+		if !ok {
+			return nil, invalidCallOptions(call)
+		}
+		return rsmq.changeMessageVisibility(ctx, options)
+	})
+	changed, _ := res.(bool)
+	return changed, err
+}
+
+func (rsmq *RedisSMQ) changeMessageVisibility(ctx context.Context, options ChangeMessageVisibilityOptions) (bool, error) {
 	if len(options.QName) == 0 || len(options.ID) == 0 {
 		return false, fmt.Errorf("ChangeMessageVisibility requires QName and ID parameters")
 	}
@@ -307,11 +634,145 @@ func (rsmq *RedisSMQ) ChangeMessageVisibility(ctx context.Context, options Chang
 		options.ID,
 		newVT,
 	}
-	val, err := rsmq.cl.EvalSha(ctx, *rsmq.hideMessageSha1, args).Int64()
+	val, err := hideMessageScript.Run(ctx, rsmq.cl, args).Int64()
+	if err != nil {
+		return false, fmt.Errorf("eval hideMessageScript: %w", err)
+	}
+
+	return val == 1, nil
+}
+
+// MoveMessage atomically moves a message to another queue, keeping its ID, visibility, rc and fr.
+// With Copy set the message is instead sent to To with a new ID and the returned ID is the copy.
+// It returns an empty ID if the message does not exist on From, and QueueFullError if To has no capacity for it.
+func (rsmq *RedisSMQ) MoveMessage(ctx context.Context, options MoveMessageOptions) (string, error) {
+	if len(options.From) == 0 || len(options.To) == 0 || len(options.ID) == 0 {
+		return "", fmt.Errorf("MoveMessage requires From, To and ID parameters")
+	}
+	if options.From == options.To {
+		return "", errors.New("MoveMessage requires From and To to be different queues")
+	}
+	q, err := rsmq.getQueue(ctx, options.From)
+	if err != nil {
+		return "", err
+	}
+	id := options.ID
+	if options.Copy {
+		id = q.UID
+	}
+	args := []string{
+		rsmq.ns + ":" + options.From,
+		rsmq.ns + ":" + options.To,
+		options.ID,
+		id,
+		q.timeSentUnix(),
+	}
+	val, err := moveMessageScript.Run(ctx, rsmq.cl, args).Int64()
 	if err != nil {
-		return false, fmt.Errorf("eval hideMessageSha1: %w", err)
+		return "", fmt.Errorf("eval moveMessageScript: %w", err)
 	}
+	switch val {
+	case -1:
+		return "", QueueNotFoundError
+	case -2:
+		return "", QueueFullError
+	case 0:
+		return "", nil
+	}
+	return id, nil
+}
 
+// MoveMessages moves every message on From which matches the Filter to To, returning the number moved.
+// Each message is moved atomically, messages sent to From while this runs may or may not be moved.
+func (rsmq *RedisSMQ) MoveMessages(ctx context.Context, options MoveMessagesOptions) (int64, error) {
+	if options.From == options.To {
+		return 0, errors.New("MoveMessages requires From and To to be different queues")
+	}
+	var moved, offset int64
+	for {
+		messages, err := rsmq.PeekMessages(ctx, PeekMessagesOptions{
+			QName:         options.From,
+			IncludeHidden: true,
+			Offset:        offset,
+			Limit:         100,
+		})
+		if err != nil {
+			return moved, fmt.Errorf("MoveMessages: %w", err)
+		}
+		if len(messages) == 0 {
+			return moved, nil
+		}
+		for _, m := range messages {
+			if options.Filter != nil && !options.Filter(m.Message) {
+				offset++
+				continue
+			}
+			id, err := rsmq.MoveMessage(ctx, MoveMessageOptions{From: options.From, To: options.To, ID: m.ID, Copy: options.Copy})
+			if err != nil {
+				return moved, fmt.Errorf("MoveMessages: %w", err)
+			}
+			if len(id) > 0 {
+				moved++
+			}
+			if options.Copy {
+				offset++
+				continue
+			}
+			if len(id) == 0 {
+				// a message deleted since the peek is gone, but a member without a body stays in place and is stepped over
+				err := rsmq.cl.ZScore(ctx, rsmq.ns+":"+options.From, m.ID).Err()
+				if err != nil && !errors.Is(err, redis.Nil) {
+					return moved, fmt.Errorf("MoveMessages: %w", err)
+				}
+				if err == nil {
+					offset++
+				}
+			}
+		}
+	}
+}
+
+// RescheduleMessage moves the time a message becomes visible to an absolute point in time.
+// It returns false if the message does not exist.
+func (rsmq *RedisSMQ) RescheduleMessage(ctx context.Context, options RescheduleMessageOptions) (bool, error) {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return false, fmt.Errorf("RescheduleMessage requires QName and ID parameters")
+	}
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return false, fmt.Errorf("getQueue: %w", err)
+	}
+	args := []string{
+		rsmq.ns + ":" + options.QName,
+		options.ID,
+		strconv.FormatInt(q.deliverAtUnix(options.At), 10),
+	}
+	val, err := hideMessageScript.Run(ctx, rsmq.cl, args).Int64()
+	if err != nil {
+		return false, fmt.Errorf("eval hideMessageScript: %w", err)
+	}
+	return val == 1, nil
+}
+
+// CancelScheduledMessage deletes a message that has not yet been delivered.
+// It returns false if the message does not exist, is already visible or has been received.
+func (rsmq *RedisSMQ) CancelScheduledMessage(ctx context.Context, options CancelScheduledMessageOptions) (bool, error) {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return false, fmt.Errorf("CancelScheduledMessage requires QName and ID parameters")
+	}
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return false, fmt.Errorf("getQueue: %w", err)
+	}
+	args := []string{
+		rsmq.ns + ":" + options.QName,
+		options.ID,
+		q.timeSentUnix(),
+	}
+	val, err := cancelMessageScript.Run(ctx, rsmq.cl, args).Int64()
+	if err != nil {
+		return false, fmt.Errorf("eval cancelMessageScript: %w", err)
+	}
 	return val == 1, nil
 }
 
@@ -325,6 +786,19 @@ func (rsmq *RedisSMQ) ListQueues(ctx context.Context) ([]string, error) {
 // Important: This method deletes the message it receives right away.
 // There is no way to receive the message again if something goes wrong while working on the message.
 func (rsmq *RedisSMQ) PopMessage(ctx context.Context, options PopMessageOptions) (*Message, error) {
+	call := &Call{Method: "PopMessage", QName: options.QName, Options: options}
+	res, err := rsmq.intercept(ctx, call, func(ctx context.Context, call *Call) (interface{}, error) {
+		options, ok := call.Options.(PopMessageOptions)
+		if !ok {
+			return nil, invalidCallOptions(call)
+		}
+		return rsmq.popMessage(ctx, options)
+	})
+	msg, _ := res.(*Message)
+	return msg, err
+}
+
+func (rsmq *RedisSMQ) popMessage(ctx context.Context, options PopMessageOptions) (*Message, error) {
 	if len(options.QName) == 0 {
 		return nil, errors.New("popMessage validation failed. Expected options.QName to be set")
 	}
@@ -333,26 +807,184 @@ func (rsmq *RedisSMQ) PopMessage(ctx context.Context, options PopMessageOptions)
 		return nil, err
 	}
 
-	res, err := rsmq.cl.EvalSha(ctx, *rsmq.popMessageSha1, []string{rsmq.ns + ":" + options.QName, q.timeSentUnix()}).Slice()
+	args := []string{rsmq.ns + ":" + options.QName, q.timeSentUnix(), rsmq.deadLetterKey(q), strconv.Itoa(q.MaxReceiveRate)}
+	res, err := popMessageScript.Run(ctx, rsmq.cl, args).Slice()
 	if err != nil {
 		return nil, fmt.Errorf("popMessage evalSha: %w", err)
 	}
 	return unmarshalMessage(res, q, nil)
 }
 
+// GetMessage looks up a single message by ID without receiving it.
+// Deadline is set when the message is hidden, and is the time it becomes visible again.
+func (rsmq *RedisSMQ) GetMessage(ctx context.Context, options GetMessageOptions) (*Message, error) {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return nil, fmt.Errorf("GetMessage requires QName and ID parameters")
+	}
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return nil, err
+	}
+	key := rsmq.ns + ":" + options.QName
+	pipe := rsmq.cl.TxPipeline()
+	score := pipe.ZScore(ctx, key, options.ID)
+	fields := pipe.HMGet(ctx, key+":Q", options.ID, options.ID+":rc", options.ID+":fr", options.ID+":meta")
+	_, err = pipe.Exec(ctx)
+	if errors.Is(err, redis.Nil) {
+		return nil, MessageNotFoundError
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetMessage: %w", err)
+	}
+	vals := fields.Val()
+	body, ok := vals[0].(string)
+	if !ok {
+		return nil, MessageNotFoundError
+	}
+	m := &Message{
+		ID:      options.ID,
+		Message: body,
+		Sent:    SentFromID(options.ID),
+	}
+	if rc, ok := vals[1].(string); ok {
+		m.RC, err = strconv.ParseInt(rc, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("GetMessage: could not parse the rc string: %w", err)
+		}
+	}
+	if fr, ok := vals[2].(string); ok {
+		frInt, err := strconv.ParseInt(fr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("GetMessage: could not parse the fr string: %w", err)
+		}
+		m.FR = time.UnixMilli(frInt)
+	}
+	if meta, ok := vals[3].(string); ok {
+		m.Metadata, err = unmarshalMetadata(meta)
+		if err != nil {
+			return nil, fmt.Errorf("GetMessage: %w", err)
+		}
+	}
+	visibleAt := int64(score.Val())
+	m.State = messageState(visibleAt, m.RC, q.TimeSent)
+	m.Cursor = messageCursor(visibleAt, m.ID)
+	if m.State != MessageVisible {
+		deadline := time.UnixMilli(visibleAt)
+		m.Deadline = &deadline
+	}
+	return m, nil
+}
+
+// PeekMessages returns messages on the queue without receiving them.
+// Unlike ReceiveMessage nothing is modified, so rc, fr, totalrecv and visibility are untouched.
+func (rsmq *RedisSMQ) PeekMessages(ctx context.Context, options PeekMessagesOptions) ([]*Message, error) {
+	if len(options.QName) == 0 {
+		return nil, errors.New("peekMessages validation failed. Expected options.QName to be set")
+	}
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return nil, err
+	}
+	limit := options.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	max := q.timeSentUnix()
+	if options.IncludeHidden {
+		max = "+inf"
+	}
+	min, after := "-inf", ""
+	if len(options.After) > 0 {
+		min, after, err = parseMessageCursor(options.After)
+		if err != nil {
+			return nil, fmt.Errorf("PeekMessages: After: %w", err)
+		}
+	}
+	args := []string{
+		rsmq.ns + ":" + options.QName,
+		max,
+		strconv.FormatInt(options.Offset, 10),
+		strconv.FormatInt(limit, 10),
+		min,
+		after,
+	}
+	res, err := peekMessagesScript.Run(ctx, rsmq.cl, args).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("peekMessages evalSha: %w", err)
+	}
+	return unmarshalPeekedMessages(res, q)
+}
+
+// ExpireMessages removes every message which has passed its TTL or the queue retention period,
+// routing them to the DeadLetterQueue when one is set. It returns the number of messages expired.
+//
+// Receive and Pop skip expired messages on their own, this sweeps the messages nobody is receiving.
+// Run it periodically, e.g. with rsmq expire or the sweep of cmd/qd.
+func (rsmq *RedisSMQ) ExpireMessages(ctx context.Context, options ExpireMessagesOptions) (int64, error) {
+	if len(options.QName) == 0 {
+		return 0, errors.New("QName is empty")
+	}
+	var expired, offset int64
+	const count = 100
+	for {
+		q, err := rsmq.getQueue(ctx, options.QName)
+		if err != nil {
+			return expired, err
+		}
+		args := []string{
+			rsmq.ns + ":" + options.QName,
+			q.timeSentUnix(),
+			rsmq.deadLetterKey(q),
+			strconv.FormatInt(offset, 10),
+			strconv.FormatInt(count, 10),
+		}
+		res, err := expireMessagesScript.Run(ctx, rsmq.cl, args).Int64Slice()
+		if err != nil {
+			return expired, fmt.Errorf("ExpireMessages: %w", err)
+		}
+		if len(res) != 2 {
+			return expired, fmt.Errorf("ExpireMessages: unexpected result set %v", res)
+		}
+		scanned, removed := res[0], res[1]
+		expired += removed
+		if scanned < count {
+			return expired, nil
+		}
+		offset += scanned - removed
+	}
+}
+
+// SetAttributesOptions VisibilityTimeout and DelayForMessages are in seconds
 type SetAttributesOptions struct {
 	QName             string
 	DelayForMessages  *int
 	VisibilityTimeout *int
 	Maxsize           *int64
+	// MessageRetentionSeconds of 0 keeps messages forever, it only applies to messages sent after it is set
+	MessageRetentionSeconds *int
+	// DeadLetterQueue of "" drops expired messages
+	DeadLetterQueue *string
+	// MaxReceivesPerSecond of 0 removes the limit
+	MaxReceivesPerSecond *int
+	// MaxMessages of 0 removes the limit
+	MaxMessages *int64
+	// MaxBytes of 0 removes the limit. Setting a limit recounts the bytes on the queue,
+	// so messages sent by versions which did not keep the count are included, this reads every message body once.
+	MaxBytes *int64
 }
 
 func (rsmq *RedisSMQ) SetQueueAttributes(ctx context.Context, options SetAttributesOptions) (*QueueAttributes, error) {
 	if len(options.QName) == 0 {
 		return nil, errors.New("QName must be provided")
 	}
-	if options.DelayForMessages == nil && options.VisibilityTimeout == nil && options.Maxsize == nil {
-		return nil, errors.New("must provide a new value for DelayForMessages, Visibility or MaxSize")
+	if options.DelayForMessages == nil && options.VisibilityTimeout == nil && options.Maxsize == nil &&
+		options.MessageRetentionSeconds == nil && options.DeadLetterQueue == nil && options.MaxReceivesPerSecond == nil &&
+		options.MaxMessages == nil && options.MaxBytes == nil {
+		return nil, errors.New("must provide a new value for at least one queue attribute")
+	}
+
+	if options.DeadLetterQueue != nil && *options.DeadLetterQueue == options.QName {
+		return nil, errors.New("DeadLetterQueue must be a different queue")
 	}
 
 	_, err := rsmq.getQueue(ctx, options.QName)
@@ -367,7 +999,7 @@ func (rsmq *RedisSMQ) SetQueueAttributes(ctx context.Context, options SetAttribu
 
 	qKey := rsmq.ns + ":" + options.QName + ":" + "Q"
 	pl := rsmq.cl.Pipeline()
-	pl.HSet(ctx, qKey, "modified", t)
+	pl.HSet(ctx, qKey, "modified", t.Unix())
 	if options.DelayForMessages != nil {
 		pl.HSet(ctx, qKey, "delay", *options.DelayForMessages)
 	}
@@ -377,10 +1009,30 @@ func (rsmq *RedisSMQ) SetQueueAttributes(ctx context.Context, options SetAttribu
 	if options.VisibilityTimeout != nil {
 		pl.HSet(ctx, qKey, "vt", *options.VisibilityTimeout)
 	}
+	if options.MessageRetentionSeconds != nil {
+		pl.HSet(ctx, qKey, "retention", *options.MessageRetentionSeconds)
+	}
+	if options.DeadLetterQueue != nil {
+		pl.HSet(ctx, qKey, "dlq", *options.DeadLetterQueue)
+	}
+	if options.MaxReceivesPerSecond != nil {
+		pl.HSet(ctx, qKey, "maxrecvrate", *options.MaxReceivesPerSecond)
+	}
+	if options.MaxMessages != nil {
+		pl.HSet(ctx, qKey, "maxmsgs", *options.MaxMessages)
+	}
+	if options.MaxBytes != nil {
+		pl.HSet(ctx, qKey, "maxbytes", *options.MaxBytes)
+	}
 	_, err = pl.Exec(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("SetQueueAttributes: %w", err)
 	}
+	if options.MaxBytes != nil && *options.MaxBytes > 0 {
+		if err := countBytesScript.Run(ctx, rsmq.cl, []string{rsmq.ns + ":" + options.QName}).Err(); err != nil {
+			return nil, fmt.Errorf("SetQueueAttributes: eval countBytesScript: %w", err)
+		}
+	}
 
 	attributes, err := rsmq.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: options.QName})
 	if err != nil {
@@ -393,33 +1045,16 @@ func (rsmq *RedisSMQ) Close() error {
 	return rsmq.cl.Close()
 }
 
-func (rsmq *RedisSMQ) initScripts(ctx context.Context) error {
-	popMessage := rsmq.cl.ScriptLoad(ctx, scriptPopMessage)
-	popMessageSha1, err := popMessage.Result()
-	if err != nil {
-		return fmt.Errorf("init scriptPopMessage: %w", err)
-	}
-	rsmq.popMessageSha1 = &popMessageSha1
-
-	receiveMessage := rsmq.cl.ScriptLoad(ctx, scriptReceiveMessage)
-	receiveMessageSha1, err := receiveMessage.Result()
-	if err != nil {
-		return fmt.Errorf("init script_recieveMessage: %w", err)
-	}
-	rsmq.receiveMessageSha1 = &receiveMessageSha1
-
-	changeVisMessage := rsmq.cl.ScriptLoad(ctx, scriptChangeMessageVisibility)
-	hideMessageSha1, err := changeVisMessage.Result()
-	if err != nil {
-		return fmt.Errorf("init scriptChangeMessageVisibility: %w", err)
-	}
-	rsmq.hideMessageSha1 = &hideMessageSha1
-	return nil
-}
-
 type Options struct {
 	Client    *redis.Client
 	NameSpace *string
+	// TracerProvider creates the send and process spans, defaults to the global otel provider
+	TracerProvider trace.TracerProvider
+	// Propagator injects the trace context into message metadata, defaults to W3C trace context
+	Propagator propagation.TextMapPropagator
+	// Interceptors wrap SendMessage, ReceiveMessage, PopMessage, DeleteMessage and ChangeMessageVisibility.
+	// The first interceptor is the outermost.
+	Interceptors []Interceptor
 }
 
 // New creates the RedisSMQ
@@ -440,11 +1075,15 @@ func New(ctx context.Context, opts Options) (*RedisSMQ, error) {
 	} else {
 		ns = "rsmq"
 	}
-	rq := &RedisSMQ{cl: cl, ns: ns}
-	err := rq.initScripts(ctx)
-	if err != nil {
-		return nil, err
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	propagator := opts.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
 	}
+	rq := &RedisSMQ{cl: cl, ns: ns, tracer: tp.Tracer(tracerName), propagator: propagator, interceptors: opts.Interceptors}
 	return rq, nil
 }
 
@@ -453,8 +1092,16 @@ func unmarshalMessage(results []interface{}, q *qAttr, vt *int) (*Message, error
 	if len(results) == 0 {
 		return nil, nil
 	}
-	if len(results) != 4 {
-		return nil, fmt.Errorf("unexpected result set, expected 4 items but got %v", results)
+	// a single item is the number of milliseconds until the rate limit allows another receive
+	if len(results) == 1 {
+		retryAfter, ok := results[0].(int64)
+		if !ok {
+			return nil, fmt.Errorf("could not serialize int64 type from rate limit result")
+		}
+		return nil, &RateLimitError{RetryAfter: time.Duration(retryAfter) * time.Millisecond}
+	}
+	if len(results) != 5 {
+		return nil, fmt.Errorf("unexpected result set, expected 5 items but got %v", results)
 	}
 	uid, ok := results[0].(string)
 	if !ok {
@@ -476,30 +1123,93 @@ func unmarshalMessage(results []interface{}, q *qAttr, vt *int) (*Message, error
 	if err != nil {
 		return nil, fmt.Errorf("could not parse the timestamp string: %w", err)
 	}
+	meta, ok := results[4].(string)
+	if !ok {
+		return nil, fmt.Errorf("could not serialize metadata string type from fifth element")
+	}
+	metadata, err := unmarshalMetadata(meta)
+	if err != nil {
+		return nil, err
+	}
 	if vt == nil {
 		vt = &q.VisibilityTimeout
 	}
 	deadline := q.TimeSent.Add(time.Duration(*vt) * time.Second)
+	sent := SentFromID(uid)
+	if sent.IsZero() {
+		sent = q.TimeSent
+	}
 	return &Message{
 		ID:       uid,
 		Message:  msg,
 		RC:       rc,
 		FR:       time.UnixMilli(tsInt),
-		Sent:     q.TimeSent,
+		Sent:     sent,
 		Deadline: &deadline,
+		Metadata: metadata,
 	}, nil
 }
 
-// makeUID returns a cryptographically random ID for a string
-func makeUID(n int) string {
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	s := make([]rune, n)
-	for i := range s {
-		b, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+// unmarshalMetadata reads the JSON stored in the :meta field of a message, which is empty when there is no metadata
+func unmarshalMetadata(meta string) (map[string]string, error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(meta), &metadata); err != nil {
+		return nil, fmt.Errorf("could not parse the metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// unmarshalPeekedMessages reads the flat id, body, rc, fr, score, metadata list returned by scriptPeekMessages
+func unmarshalPeekedMessages(results []interface{}, q *qAttr) ([]*Message, error) {
+	if len(results)%6 != 0 {
+		return nil, fmt.Errorf("unexpected result set, expected groups of 6 items but got %v", results)
+	}
+	messages := make([]*Message, 0, len(results)/6)
+	for i := 0; i < len(results); i += 6 {
+		fields := make([]string, 6)
+		for j := range fields {
+			v, ok := results[i+j].(string)
+			if !ok {
+				return nil, fmt.Errorf("could not serialize string type from element %d", i+j)
+			}
+			fields[j] = v
+		}
+		rc, err := strconv.ParseInt(fields[2], 10, 64)
 		if err != nil {
-			log.Fatalln("Fatal error making a secure unique ID:", err)
+			return nil, fmt.Errorf("could not parse the rc string: %w", err)
+		}
+		score, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the score string: %w", err)
+		}
+		metadata, err := unmarshalMetadata(fields[5])
+		if err != nil {
+			return nil, err
+		}
+		m := &Message{
+			ID:       fields[0],
+			Message:  fields[1],
+			RC:       rc,
+			Sent:     SentFromID(fields[0]),
+			State:    messageState(int64(score), rc, q.TimeSent),
+			Metadata: metadata,
+			Cursor:   messageCursor(int64(score), fields[0]),
+		}
+		if len(fields[3]) > 0 {
+			fr, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse the fr string: %w", err)
+			}
+			m.FR = time.UnixMilli(fr)
+		}
+		if m.State != MessageVisible {
+			deadline := time.UnixMilli(int64(score))
+			m.Deadline = &deadline
 		}
-		s[i] = letters[b.Int64()]
+		messages = append(messages, m)
 	}
-	return string(s)
+	return messages, nil
 }
@@ -2,6 +2,7 @@ package q
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"os"
@@ -9,20 +10,30 @@ import (
 	"time"
 )
 
-func newQ(name string) (string, *RedisSMQ, context.Context, error) {
-	qname := name + makeUID(4)
-
-	ctx := context.Background()
+// testClient connects to the redis server at REDIS_URL, or localhost when it is not set,
+// the tests outside this package use qtest.RedisClient
+func testClient() (*redis.Client, error) {
 	url := os.Getenv("REDIS_URL")
 	if len(url) == 0 {
 		url = "redis://localhost:6379"
 	}
 	opts, err := redis.ParseURL(url)
 	if err != nil {
-		return "", nil, ctx, fmt.Errorf("parseURL: %w", err)
+		return nil, fmt.Errorf("parseURL: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+func newQ(name string) (string, *RedisSMQ, context.Context, error) {
+	qname := name + makeUID(4)
+
+	ctx := context.Background()
+	cl, err := testClient()
+	if err != nil {
+		return "", nil, ctx, err
 	}
 	q, err := New(ctx, Options{
-		Client: redis.NewClient(opts),
+		Client: cl,
 	})
 	if err != nil {
 		return "", nil, ctx, fmt.Errorf("new rsmq client: %w", err)
@@ -125,6 +136,28 @@ func TestSimple(t *testing.T) {
 	}
 }
 
+func TestScriptFlush(t *testing.T) {
+	qname, q, ctx, err := newQ("TestScriptFlush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qname})
+	// a restarted or failed over server has no scripts cached
+	if err := q.cl.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qname, Message: "after flush"}); err != nil {
+		t.Fatalf("expected the send script to be loaded again but got %v", err)
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.Message != "after flush" {
+		t.Fatalf("expected to receive the message sent after the flush but got %v", message)
+	}
+}
+
 func TestDeleteMessage(t *testing.T) {
 	qname, q, ctx, err := newQ("TestDeleteMessageQ")
 	if err != nil {
@@ -336,3 +369,754 @@ func TestSetQueueValidatesParams(t *testing.T) {
 
 	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
 }
+
+func TestDeliverAt(t *testing.T) {
+	qName, q, ctx, err := newQ("TestDeliverAt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := q.SendMessage(ctx, SendMessageRequestOptions{
+		QName:     qName,
+		Message:   "remind me later",
+		DeliverAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != nil {
+		t.Fatalf("scheduled message should not be visible yet but got %s", message)
+	}
+
+	ok, err := q.RescheduleMessage(ctx, RescheduleMessageOptions{QName: qName, ID: uid, At: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected reschedule of an existing message to succeed")
+	}
+	message, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.ID != uid {
+		t.Fatalf("expected the rescheduled message %s but got %s", uid, message)
+	}
+
+	ok, err = q.RescheduleMessage(ctx, RescheduleMessageOptions{QName: qName, ID: "fakeUIDofMessage", At: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("reschedule should return false if the message does not exist")
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestCancelScheduledMessage(t *testing.T) {
+	qName, q, ctx, err := newQ("TestCancelScheduled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := q.SendMessage(ctx, SendMessageRequestOptions{
+		QName:     qName,
+		Message:   "never mind",
+		DeliverAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := q.CancelScheduledMessage(ctx, CancelScheduledMessageOptions{QName: qName, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected the scheduled message to be cancelled")
+	}
+	ok, err = q.CancelScheduledMessage(ctx, CancelScheduledMessageOptions{QName: qName, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("cancelling twice should return false")
+	}
+
+	visible, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "already here"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = q.CancelScheduledMessage(ctx, CancelScheduledMessageOptions{QName: qName, ID: visible})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("a visible message should not be cancelled")
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestPeekMessages(t *testing.T) {
+	qName, q, ctx, err := newQ("TestPeekMessages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "second", DeliverAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := q.PeekMessages(ctx, PeekMessagesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != first || messages[0].Message != "first" {
+		t.Fatalf("expected only the visible message %s but got %v", first, messages)
+	}
+	if messages[0].Deadline != nil {
+		t.Fatalf("a visible message should not have a deadline but got %s", messages[0].Deadline)
+	}
+
+	messages, err = q.PeekMessages(ctx, PeekMessagesOptions{QName: qName, IncludeHidden: true, Offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != second {
+		t.Fatalf("expected the delayed message %s on the second page but got %v", second, messages)
+	}
+	if messages[0].Deadline == nil {
+		t.Fatal("a hidden message should report when it becomes visible")
+	}
+
+	attributes, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.TotalReceived != 0 {
+		t.Fatalf("peeking should not count as receiving but totalrecv = %d", attributes.TotalReceived)
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.ID != first || message.RC != 1 {
+		t.Fatalf("expected to receive the peeked message for the first time but got %s", message)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestPeekMessagesAfter(t *testing.T) {
+	qName, q, ctx, err := newQ("TestPeekMessagesAfter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// messages delivered at the same time share a score, so the page boundary falls between them
+	at := time.Now().Add(time.Hour)
+	sent := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		id, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "tied", DeliverAt: at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[id] = true
+	}
+
+	first, err := q.PeekMessages(ctx, PeekMessagesOptions{QName: qName, IncludeHidden: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("expected a page of 2 messages but got %v", first)
+	}
+	second, err := q.PeekMessages(ctx, PeekMessagesOptions{QName: qName, IncludeHidden: true, Limit: 2, After: first[1].Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 {
+		t.Fatalf("expected the last message after the first page but got %v", second)
+	}
+	for _, m := range append(first, second...) {
+		if !sent[m.ID] {
+			t.Fatalf("expected each message once but got %s again", m.ID)
+		}
+		delete(sent, m.ID)
+	}
+
+	// a message from GetMessage continues from the same place
+	last, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: second[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := q.PeekMessages(ctx, PeekMessagesOptions{QName: qName, IncludeHidden: true, After: last.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected nothing after the last message but got %v", rest)
+	}
+	if _, err := q.PeekMessages(ctx, PeekMessagesOptions{QName: qName, After: second[0].ID}); err == nil {
+		t.Fatal("expected an ID which is not a cursor to be rejected")
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestGetMessage(t *testing.T) {
+	qName, q, ctx, err := newQ("TestGetMessage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "inspect me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Message != "inspect me" || message.RC != 0 || message.State != MessageVisible {
+		t.Fatalf("expected an unreceived visible message but got %s", message)
+	}
+	if time.Since(message.Sent) > time.Minute {
+		t.Fatalf("expected the sent time to be decoded from the ID but got %s", message.Sent)
+	}
+
+	_, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err = q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.RC != 1 || message.State != MessageInFlight || message.Deadline == nil || message.FR.IsZero() {
+		t.Fatalf("expected a received in-flight message but got %s", message)
+	}
+
+	_, err = q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: "fakeUIDofMessage"})
+	if err != MessageNotFoundError {
+		t.Fatalf("expected MessageNotFoundError but got %v", err)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestPurgeQueue(t *testing.T) {
+	qName, q, ctx, err := newQ("TestPurgeQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedVT := 45
+	_, err = q.SetQueueAttributes(ctx, SetAttributesOptions{QName: qName, VisibilityTimeout: &expectedVT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uids []string
+	for i := 0; i < 3; i++ {
+		uid, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "purge me"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, uid)
+	}
+	_, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := q.PurgeQueue(ctx, PurgeQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 messages to be purged but got %d", n)
+	}
+	for _, uid := range uids {
+		_, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: uid})
+		if err != MessageNotFoundError {
+			t.Fatalf("expected %s to be purged but got %v", uid, err)
+		}
+	}
+	attributes, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.CurrentN != 0 || attributes.VisibilityTimeout != expectedVT || attributes.TotalSent != 3 {
+		t.Fatalf("expected an empty queue with attributes and counters kept but got %s", attributes)
+	}
+
+	_, err = q.PurgeQueue(ctx, PurgeQueueOptions{QName: "bogus-shouldneverexist" + makeUID(12)})
+	if err != QueueNotFoundError {
+		t.Fatalf("expected QueueNotFoundError but got %v", err)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestMoveMessage(t *testing.T) {
+	from, q, ctx, err := newQ("TestMoveMessageFrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := "TestMoveMessageTo" + makeUID(4)
+	err = q.CreateQueue(ctx, CreateQueueRequestOptions{QName: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: from, Message: "shunt me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := q.MoveMessage(ctx, MoveMessageOptions{From: from, To: to, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != uid {
+		t.Fatalf("expected the message to keep its ID %s but got %q", uid, moved)
+	}
+	if _, err := q.GetMessage(ctx, GetMessageOptions{QName: from, ID: uid}); err != MessageNotFoundError {
+		t.Fatalf("expected the message to be removed from the source queue but got %v", err)
+	}
+	message, err := q.GetMessage(ctx, GetMessageOptions{QName: to, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Message != "shunt me" || message.RC != 1 || message.State != MessageInFlight {
+		t.Fatalf("expected the moved message to keep its body, rc and visibility but got %s", message)
+	}
+	attributes, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.TotalSent != 1 {
+		t.Fatalf("expected totalsent to be incremented on the destination but got %d", attributes.TotalSent)
+	}
+
+	moved, err = q.MoveMessage(ctx, MoveMessageOptions{From: from, To: to, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != "" {
+		t.Fatal("moving a message that is not on the source queue should return an empty ID")
+	}
+	_, err = q.MoveMessage(ctx, MoveMessageOptions{From: to, To: "bogus-shouldneverexist" + makeUID(12), ID: uid})
+	if err != QueueNotFoundError {
+		t.Fatalf("expected QueueNotFoundError for a missing destination but got %v", err)
+	}
+
+	// a copy expires when the original does
+	uid, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: from, Message: "short lived", TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := q.MoveMessage(ctx, MoveMessageOptions{From: from, To: to, ID: uid, Copy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := q.cl.HMGet(ctx, q.ns+":"+from+":Q", uid+":exp").Val()[0]
+	if copiedExp := q.cl.HGet(ctx, q.ns+":"+to+":Q", copied+":exp").Val(); exp == nil || copiedExp != exp {
+		t.Fatalf("expected the copy to expire at %v but got %q", exp, copiedExp)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: from})
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: to})
+}
+
+func TestMoveMessages(t *testing.T) {
+	from, q, ctx, err := newQ("TestMoveMessagesFrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := "TestMoveMessagesTo" + makeUID(4)
+	err = q.CreateQueue(ctx, CreateQueueRequestOptions{QName: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"fast", "slow", "fast", "slow", "fast"} {
+		_, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: from, Message: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := q.MoveMessages(ctx, MoveMessagesOptions{From: from, To: to, Filter: func(body string) bool {
+		return body == "fast"
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 messages to be moved but got %d", n)
+	}
+	n, err = q.MoveMessages(ctx, MoveMessagesOptions{From: from, To: to, Copy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 messages to be copied but got %d", n)
+	}
+	for qName, expected := range map[string]int64{from: 2, to: 5} {
+		attributes, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attributes.CurrentN != expected {
+			t.Fatalf("expected %s to have %d messages but got %d", qName, expected, attributes.CurrentN)
+		}
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: from})
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: to})
+}
+
+func TestMoveMessagesSkipsOrphans(t *testing.T) {
+	from, q, ctx, err := newQ("TestMoveMessagesOrphanFrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := "TestMoveMessagesOrphanTo" + makeUID(4)
+	err = q.CreateQueue(ctx, CreateQueueRequestOptions{QName: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: from})
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: to})
+	// a member without a body, ahead of the message on the queue
+	if err := q.cl.ZAdd(ctx, q.ns+":"+from, &redis.Z{Score: 0, Member: "orphan"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: from, Message: "body"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int64)
+	go func() {
+		n, err := q.MoveMessages(ctx, MoveMessagesOptions{From: from, To: to})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Fatalf("expected the message to be moved but moved %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MoveMessages did not return with an orphan member on the queue")
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	qName, q, ctx, err := newQ("TestMessageTTL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "stale", TTL: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "fresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.ID != fresh {
+		t.Fatalf("expected the expired message to be skipped and %s received but got %s", fresh, message)
+	}
+	if _, err := q.GetMessage(ctx, GetMessageOptions{QName: qName, ID: expired}); err != MessageNotFoundError {
+		t.Fatalf("expected the expired message to be removed but got %v", err)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestReceiveExpiresInBatches(t *testing.T) {
+	qName, q, ctx, err := newQ("TestReceiveExpiresInBatches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	for i := 0; i < MaxExpiresPerReceive+1; i++ {
+		_, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "stale", TTL: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "fresh", DeliverAt: time.Now().Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != nil {
+		t.Fatalf("expected no message while expiring the first batch but got %s", message)
+	}
+	message, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.ID != fresh {
+		t.Fatalf("expected %s once the expired messages are gone but got %s", fresh, message)
+	}
+}
+
+func TestExpireMessagesToDeadLetterQueue(t *testing.T) {
+	qName, q, ctx, err := newQ("TestRetention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlq := "TestRetentionDLQ" + makeUID(4)
+	err = q.CreateQueue(ctx, CreateQueueRequestOptions{QName: dlq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retention := 1
+	attributes, err := q.SetQueueAttributes(ctx, SetAttributesOptions{
+		QName:                   qName,
+		MessageRetentionSeconds: &retention,
+		DeadLetterQueue:         &dlq,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.MessageRetentionSeconds != retention || attributes.DeadLetterQueue != dlq {
+		t.Fatalf("expected retention and dead letter queue to be set but got %s", attributes)
+	}
+	uid, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "nobody wants me", TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	n, err := q.ExpireMessages(ctx, ExpireMessagesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected the retention period to expire 1 message but got %d", n)
+	}
+	message, err := q.GetMessage(ctx, GetMessageOptions{QName: dlq, ID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Message != "nobody wants me" || message.State != MessageVisible {
+		t.Fatalf("expected the expired message to be visible on the dead letter queue but got %s", message)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: dlq})
+}
+
+func TestReceiveRateLimit(t *testing.T) {
+	qName, q, ctx, err := newQ("TestReceiveRateLimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate := 2
+	attributes, err := q.SetQueueAttributes(ctx, SetAttributesOptions{QName: qName, MaxReceivesPerSecond: &rate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.MaxReceivesPerSecond != rate {
+		t.Fatalf("expected MaxReceivesPerSecond = %d but got %d", rate, attributes.MaxReceivesPerSecond)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "limited"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < rate; i++ {
+		message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message == nil {
+			t.Fatal("expected a message within the rate limit")
+		}
+	}
+	message, err := q.PopMessage(ctx, PopMessageOptions{QName: qName})
+	var rateLimited *RateLimitError
+	if !errors.As(err, &rateLimited) {
+		t.Fatalf("expected a RateLimitError once the budget is used but got %v and %s", err, message)
+	}
+	if rateLimited.RetryAfter <= 0 || rateLimited.RetryAfter > time.Second {
+		t.Fatalf("expected a retry after hint within a second but got %s", rateLimited.RetryAfter)
+	}
+
+	time.Sleep(rateLimited.RetryAfter)
+	message, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil {
+		t.Fatal("expected a message once the bucket refilled")
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestQueueFull(t *testing.T) {
+	qName, q, ctx, err := newQ("TestQueueFull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxMessages, maxBytes := int64(2), int64(10)
+	attributes, err := q.SetQueueAttributes(ctx, SetAttributesOptions{QName: qName, MaxMessages: &maxMessages, MaxBytes: &maxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.MaxMessages != maxMessages || attributes.MaxBytes != maxBytes {
+		t.Fatalf("expected the capacity to be set but got %s", attributes)
+	}
+
+	first, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "12345"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "123456"})
+	if !errors.Is(err, QueueFullError) {
+		t.Fatalf("expected QueueFullError when over MaxBytes but got %v", err)
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "12345"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "1"})
+	if !errors.Is(err, QueueFullError) {
+		t.Fatalf("expected QueueFullError when over MaxMessages but got %v", err)
+	}
+	attributes, err = q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.CurrentN != 2 || attributes.CurrentBytes != 10 {
+		t.Fatalf("expected 2 messages of 10 bytes but got %s", attributes)
+	}
+
+	err = q.DeleteMessage(ctx, DeleteMessageRequest{QName: qName, ID: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "12345"})
+	if err != nil {
+		t.Fatalf("expected capacity once a message was deleted but got %v", err)
+	}
+	_, err = q.PurgeQueue(ctx, PurgeQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, err = q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.CurrentBytes != 0 {
+		t.Fatalf("expected no bytes after purge but got %d", attributes.CurrentBytes)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestMaxBytesCountsExistingMessages(t *testing.T) {
+	qName, q, ctx, err := newQ("TestMaxBytesCountsExisting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "12345"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a message sent by a version which did not count bytes
+	q.cl.HDel(ctx, q.ns+":"+qName+":Q", "bytes")
+
+	maxBytes := int64(8)
+	attributes, err := q.SetQueueAttributes(ctx, SetAttributesOptions{QName: qName, MaxBytes: &maxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes.CurrentBytes != 5 {
+		t.Fatalf("expected the existing message to be counted but got %s", attributes)
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "12345"})
+	if !errors.Is(err, QueueFullError) {
+		t.Fatalf("expected QueueFullError counting the existing message but got %v", err)
+	}
+}
+
+func TestPauseQueue(t *testing.T) {
+	qName, q, ctx, err := newQ("TestPauseQueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.PauseQueue(ctx, PauseQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "paused"})
+	if err != nil {
+		t.Fatalf("expected sends to succeed on a paused queue but got %v", err)
+	}
+	attributes, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attributes.Paused {
+		t.Fatal("expected the queue attributes to report the queue as paused")
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != nil {
+		t.Fatalf("expected no message from a paused queue but got %s", message)
+	}
+	message, err = q.PopMessage(ctx, PopMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != nil {
+		t.Fatalf("expected no message popped from a paused queue but got %s", message)
+	}
+
+	err = q.ResumeQueue(ctx, ResumeQueueOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message == nil || message.ID != id {
+		t.Fatalf("expected to receive %s once resumed but got %s", id, message)
+	}
+
+	err = q.PauseQueue(ctx, PauseQueueOptions{QName: "does-not-exist" + makeUID(4)})
+	if err != QueueNotFoundError {
+		t.Fatalf("expected QueueNotFoundError but got %v", err)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
@@ -1,10 +1,142 @@
 package q
 
-const scriptPopMessage = `local msg = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", KEYS[2], "LIMIT", "0", "1")
-			if #msg == 0 then
+import "github.com/go-redis/redis/v8"
+
+// scriptMessages is prepended to scripts which add or remove messages, it keeps the bytes counter of the queue up to date.
+// full is true when a message of size bytes would not fit within the maxmsgs or maxbytes of the queue.
+// tick counts an event in the per minute throughput bucket of the queue, buckets expire after throughputRetention.
+const scriptMessages = `local function tick(key, field, now)
+				local bucket = key .. ":TP:" .. math.floor(tonumber(now) / 60000)
+				redis.call("HINCRBY", bucket, field, 1)
+				redis.call("EXPIRE", bucket, ` + throughputRetention + `)
+			end
+			local function add(key, id, score, body, now)
+				redis.call("ZADD", key, score, id)
+				redis.call("HSET", key .. ":Q", id, body)
+				redis.call("HINCRBY", key .. ":Q", "bytes", #body)
+				redis.call("HINCRBY", key .. ":Q", "totalsent", 1)
+				tick(key, "sent", now)
+			end
+			local function remove(key, id)
+				local size = redis.call("HSTRLEN", key .. ":Q", id)
+				redis.call("ZREM", key, id)
+				redis.call("HDEL", key .. ":Q", id, id .. ":rc", id .. ":fr", id .. ":exp", id .. ":meta")
+				if size > 0 and redis.call("HINCRBY", key .. ":Q", "bytes", -size) < 0 then
+					redis.call("HSET", key .. ":Q", "bytes", 0)
+				end
+			end
+			local function full(key, size)
+				local l = redis.call("HMGET", key .. ":Q", "maxmsgs", "maxbytes", "bytes")
+				local maxmsgs, maxbytes = tonumber(l[1]) or 0, tonumber(l[2]) or 0
+				if maxmsgs > 0 and redis.call("ZCARD", key) >= maxmsgs then
+					return true
+				end
+				return maxbytes > 0 and (tonumber(l[3]) or 0) + size > maxbytes
+			end
+			`
+
+const scriptSendMessage = scriptMessages + `if redis.call("EXISTS", KEYS[1] .. ":Q") == 0 then
+				return -1
+			end
+			if full(KEYS[1], #KEYS[4]) then
+				return 0
+			end
+			add(KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[7])
+			if KEYS[5] ~= "" then
+				redis.call("HSET", KEYS[1] .. ":Q", KEYS[2] .. ":exp", KEYS[5])
+			end
+			if KEYS[6] ~= "" then
+				redis.call("HSET", KEYS[1] .. ":Q", KEYS[2] .. ":meta", KEYS[6])
+			end
+			return 1`
+
+const scriptDeleteMessage = scriptMessages + `if redis.call("ZSCORE", KEYS[1], KEYS[2]) then
+				tick(KEYS[1], "del", KEYS[3])
+			end
+			remove(KEYS[1], KEYS[2])
+			return 1`
+
+// scriptExpire is prepended to scripts which skip or remove expired messages, after scriptMessages.
+// An expired message is moved to the dead letter queue dlq when it exists, otherwise it is dropped.
+// When dlq is full the message is dropped and counted in the dlqdropped counter of its queue.
+// A receive expires at most maxExpires messages, which is MaxExpiresPerReceive.
+const scriptExpire = `local maxExpires = 100
+			local function expired(key, id, now)
+				local exp = redis.call("HGET", key .. ":Q", id .. ":exp")
+				return exp and tonumber(exp) <= tonumber(now)
+			end
+			local function expire(key, id, now, dlq)
+				local m = redis.call("HMGET", key .. ":Q", id, id .. ":rc", id .. ":fr", id .. ":meta")
+				remove(key, id)
+				if dlq == "" or not m[1] or redis.call("EXISTS", dlq .. ":Q") == 0 then
+					return
+				end
+				if full(dlq, #m[1]) then
+					redis.call("HINCRBY", key .. ":Q", "dlqdropped", 1)
+					return
+				end
+				add(dlq, id, now, m[1], now)
+				if m[2] then
+					redis.call("HSET", dlq .. ":Q", id .. ":rc", m[2])
+				end
+				if m[3] then
+					redis.call("HSET", dlq .. ":Q", id .. ":fr", m[3])
+				end
+				if m[4] then
+					redis.call("HSET", dlq .. ":Q", id .. ":meta", m[4])
+				end
+			end
+			`
+
+// scriptRateLimit is prepended to scripts which receive messages.
+// The token bucket for a queue holds up to rate tokens and refills at rate tokens per second,
+// refill returns nil when the queue has no rate limit.
+const scriptRateLimit = `local function refill(key, rate, now)
+				rate = tonumber(rate)
+				if rate <= 0 then
+					return nil
+				end
+				local b = redis.call("HMGET", key .. ":RL", "tokens", "ts")
+				local tokens = tonumber(b[1]) or rate
+				local ts = tonumber(b[2]) or tonumber(now)
+				return math.min(rate, tokens + (tonumber(now) - ts) * rate / 1000)
+			end
+			local function consume(key, tokens, now)
+				if not tokens then
+					return
+				end
+				redis.call("HSET", key .. ":RL", "tokens", tostring(tokens - 1), "ts", now)
+				redis.call("PEXPIRE", key .. ":RL", 1000)
+			end
+			`
+
+const scriptPopMessage = scriptMessages + scriptExpire + scriptRateLimit + `if redis.call("HGET", KEYS[1] .. ":Q", "paused") == "1" then
 				return {}
 			end
+			local tokens = refill(KEYS[1], KEYS[4], KEYS[2])
+			if tokens and tokens < 1 then
+				return {math.ceil((1 - tokens) * 1000 / tonumber(KEYS[4]))}
+			end
+			local msg
+			local expires = 0
+			while true do
+				msg = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", KEYS[2], "LIMIT", "0", "1")
+				if #msg == 0 then
+					return {}
+				end
+				if not expired(KEYS[1], msg[1], KEYS[2]) then
+					break
+				end
+				if expires == maxExpires then
+					-- leave the rest to the next receive or ExpireMessages
+					return {}
+				end
+				expire(KEYS[1], msg[1], KEYS[2], KEYS[3])
+				expires = expires + 1
+			end
+			consume(KEYS[1], tokens, KEYS[2])
 			redis.call("HINCRBY", KEYS[1] .. ":Q", "totalrecv", 1)
+			tick(KEYS[1], "recv", KEYS[2])
 			local mbody = redis.call("HGET", KEYS[1] .. ":Q", msg[1])
 			local rc = redis.call("HINCRBY", KEYS[1] .. ":Q", msg[1] .. ":rc", 1)
 			local o = {msg[1], mbody, rc}
@@ -14,15 +146,37 @@ const scriptPopMessage = `local msg = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf
 				local fr = redis.call("HGET", KEYS[1] .. ":Q", msg[1] .. ":fr")
 				table.insert(o, fr)
 			end
-			redis.call("ZREM", KEYS[1], msg[1])
-			redis.call("HDEL", KEYS[1] .. ":Q", msg[1], msg[1] .. ":rc", msg[1] .. ":fr")
+			table.insert(o, redis.call("HGET", KEYS[1] .. ":Q", msg[1] .. ":meta") or "")
+			remove(KEYS[1], msg[1])
 			return o`
-const scriptReceiveMessage = `local msg = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", KEYS[2], "LIMIT", "0", "1")
-			if #msg == 0 then
+const scriptReceiveMessage = scriptMessages + scriptExpire + scriptRateLimit + `if redis.call("HGET", KEYS[1] .. ":Q", "paused") == "1" then
 				return {}
 			end
+			local tokens = refill(KEYS[1], KEYS[5], KEYS[2])
+			if tokens and tokens < 1 then
+				return {math.ceil((1 - tokens) * 1000 / tonumber(KEYS[5]))}
+			end
+			local msg
+			local expires = 0
+			while true do
+				msg = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", KEYS[2], "LIMIT", "0", "1")
+				if #msg == 0 then
+					return {}
+				end
+				if not expired(KEYS[1], msg[1], KEYS[2]) then
+					break
+				end
+				if expires == maxExpires then
+					-- leave the rest to the next receive or ExpireMessages
+					return {}
+				end
+				expire(KEYS[1], msg[1], KEYS[2], KEYS[4])
+				expires = expires + 1
+			end
+			consume(KEYS[1], tokens, KEYS[2])
 			redis.call("ZADD", KEYS[1], KEYS[3], msg[1])
 			redis.call("HINCRBY", KEYS[1] .. ":Q", "totalrecv", 1)
+			tick(KEYS[1], "recv", KEYS[2])
 			local mbody = redis.call("HGET", KEYS[1] .. ":Q", msg[1])
 			local rc = redis.call("HINCRBY", KEYS[1] .. ":Q", msg[1] .. ":rc", 1)
 			local o = {msg[1], mbody, rc}
@@ -33,6 +187,7 @@ const scriptReceiveMessage = `local msg = redis.call("ZRANGEBYSCORE", KEYS[1], "
 				local fr = redis.call("HGET", KEYS[1] .. ":Q", msg[1] .. ":fr")
 				table.insert(o, fr)
 			end
+			table.insert(o, redis.call("HGET", KEYS[1] .. ":Q", msg[1] .. ":meta") or "")
 			return o`
 const scriptChangeMessageVisibility = `local msg = redis.call("ZSCORE", KEYS[1], KEYS[2])
 			if not msg then
@@ -40,3 +195,238 @@ const scriptChangeMessageVisibility = `local msg = redis.call("ZSCORE", KEYS[1],
 			end
 			redis.call("ZADD", KEYS[1], KEYS[3], KEYS[2])
 			return 1`
+
+const scriptCancelScheduledMessage = scriptMessages + `local score = redis.call("ZSCORE", KEYS[1], KEYS[2])
+			if not score or tonumber(score) <= tonumber(KEYS[3]) then
+				return 0
+			end
+			if redis.call("HEXISTS", KEYS[1] .. ":Q", KEYS[2] .. ":rc") == 1 then
+				return 0
+			end
+			remove(KEYS[1], KEYS[2])
+			return 1`
+
+// scriptPeekMessages reads from score KEYS[5], skipping the messages at that score up to ID KEYS[6] when it is set.
+// Messages with the same score are ordered by ID, so those skipped are the first of the range
+const scriptPeekMessages = `local offset = tonumber(KEYS[3])
+			if KEYS[6] ~= "" then
+				local tied = redis.call("ZRANGEBYSCORE", KEYS[1], KEYS[5], KEYS[5])
+				for i = 1, #tied do
+					if tied[i] <= KEYS[6] then
+						offset = offset + 1
+					end
+				end
+			end
+			local msgs = redis.call("ZRANGEBYSCORE", KEYS[1], KEYS[5], KEYS[2], "WITHSCORES", "LIMIT", offset, KEYS[4])
+			local o = {}
+			for i = 1, #msgs, 2 do
+				local id = msgs[i]
+				local m = redis.call("HMGET", KEYS[1] .. ":Q", id, id .. ":rc", id .. ":fr", id .. ":meta")
+				table.insert(o, id)
+				table.insert(o, m[1] or "")
+				table.insert(o, m[2] or "0")
+				table.insert(o, m[3] or "")
+				table.insert(o, msgs[i + 1])
+				table.insert(o, m[4] or "")
+			end
+			return o`
+
+const scriptPurgeQueue = `local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
+			for i = 1, #msgs do
+				redis.call("HDEL", KEYS[1] .. ":Q", msgs[i], msgs[i] .. ":rc", msgs[i] .. ":fr", msgs[i] .. ":exp", msgs[i] .. ":meta")
+			end
+			redis.call("DEL", KEYS[1])
+			redis.call("HSET", KEYS[1] .. ":Q", "bytes", 0)
+			return #msgs`
+
+// scriptMoveMessage moves KEYS[3] from queue KEYS[1] to KEYS[2] when KEYS[4] is the same ID,
+// otherwise it copies the body to KEYS[2] as a new message KEYS[4] which is visible at KEYS[5].
+// It returns -1 when KEYS[2] does not exist and -2 when it is full.
+const scriptMoveMessage = scriptMessages + `if redis.call("EXISTS", KEYS[2] .. ":Q") == 0 then
+				return -1
+			end
+			local score = redis.call("ZSCORE", KEYS[1], KEYS[3])
+			if not score then
+				return 0
+			end
+			local m = redis.call("HMGET", KEYS[1] .. ":Q", KEYS[3], KEYS[3] .. ":rc", KEYS[3] .. ":fr", KEYS[3] .. ":exp", KEYS[3] .. ":meta")
+			if not m[1] then
+				return 0
+			end
+			if full(KEYS[2], #m[1]) then
+				return -2
+			end
+			if KEYS[3] == KEYS[4] then
+				add(KEYS[2], KEYS[4], score, m[1], KEYS[5])
+				if m[2] then
+					redis.call("HSET", KEYS[2] .. ":Q", KEYS[4] .. ":rc", m[2])
+				end
+				if m[3] then
+					redis.call("HSET", KEYS[2] .. ":Q", KEYS[4] .. ":fr", m[3])
+				end
+				remove(KEYS[1], KEYS[3])
+			else
+				add(KEYS[2], KEYS[4], KEYS[5], m[1], KEYS[5])
+			end
+			if m[4] then
+				redis.call("HSET", KEYS[2] .. ":Q", KEYS[4] .. ":exp", m[4])
+			end
+			if m[5] then
+				redis.call("HSET", KEYS[2] .. ":Q", KEYS[4] .. ":meta", m[5])
+			end
+			return 1`
+
+const scriptExpireMessages = scriptMessages + scriptExpire + `local msgs = redis.call("ZRANGE", KEYS[1], KEYS[4], tonumber(KEYS[4]) + tonumber(KEYS[5]) - 1)
+			local removed = 0
+			for i = 1, #msgs do
+				if expired(KEYS[1], msgs[i], KEYS[2]) then
+					expire(KEYS[1], msgs[i], KEYS[2], KEYS[3])
+					removed = removed + 1
+				end
+			end
+			return {#msgs, removed}`
+
+// scriptRemoveOrphanFields removes the message fields KEYS[2:] of messages which are not on queue KEYS[1],
+// the size of each body removed is taken off the bytes counter.
+const scriptRemoveOrphanFields = `local removed = 0
+			for i = 2, #KEYS do
+				local id = string.match(KEYS[i], "^[^:]+")
+				if not redis.call("ZSCORE", KEYS[1], id) then
+					local size = 0
+					if id == KEYS[i] then
+						size = redis.call("HSTRLEN", KEYS[1] .. ":Q", id)
+					end
+					removed = removed + redis.call("HDEL", KEYS[1] .. ":Q", KEYS[i])
+					if size > 0 and redis.call("HINCRBY", KEYS[1] .. ":Q", "bytes", -size) < 0 then
+						redis.call("HSET", KEYS[1] .. ":Q", "bytes", 0)
+					end
+				end
+			end
+			return removed`
+
+const scriptRemoveBodiless = scriptMessages + `local removed = 0
+			for i = 2, #KEYS do
+				if redis.call("HEXISTS", KEYS[1] .. ":Q", KEYS[i]) == 0 then
+					remove(KEYS[1], KEYS[i])
+					removed = removed + 1
+				end
+			end
+			return removed`
+
+// scriptQueueStats scans up to KEYS[3] messages in visibility order, returning
+// {total, visible, delayed, in flight, scanned, oldest visible id, first visible score, rc, count, rc, count...}.
+// IDs of this package start with the time they were sent in fixed width base36, so the smallest visible ID is the oldest.
+// IDs of other lengths, e.g. from the nodejs implementation, are left out of it and only counted in the first visible score.
+const scriptQueueStats = `local total = redis.call("ZCARD", KEYS[1])
+			local visible = redis.call("ZCOUNT", KEYS[1], "-inf", KEYS[2])
+			local msgs = redis.call("ZRANGE", KEYS[1], 0, tonumber(KEYS[3]) - 1, "WITHSCORES")
+			local delayed, inflight, oldest, since = 0, 0, "", ""
+			local hist = {}
+			for i = 1, #msgs, 2 do
+				local id = msgs[i]
+				local rc = tonumber(redis.call("HGET", KEYS[1] .. ":Q", id .. ":rc")) or 0
+				hist[rc] = (hist[rc] or 0) + 1
+				if tonumber(msgs[i + 1]) > tonumber(KEYS[2]) then
+					if rc > 0 then
+						inflight = inflight + 1
+					else
+						delayed = delayed + 1
+					end
+				else
+					if since == "" then
+						since = msgs[i + 1]
+					end
+					if #id == 32 and (oldest == "" or id < oldest) then
+						oldest = id
+					end
+				end
+			end
+			local o = {total, visible, delayed, inflight, #msgs / 2, oldest, since}
+			for rc, n in pairs(hist) do
+				table.insert(o, rc)
+				table.insert(o, n)
+			end
+			return o`
+
+// scriptImportMessage adds message KEYS[2] with the body, score, rc, fr, exp and meta of an export, empty fields are left unset.
+// It returns 0 when the message is already on the queue and -1 when the queue is full.
+const scriptImportMessage = scriptMessages + `if redis.call("ZSCORE", KEYS[1], KEYS[2]) then
+				return 0
+			end
+			if full(KEYS[1], #KEYS[4]) then
+				return -1
+			end
+			redis.call("ZADD", KEYS[1], KEYS[3], KEYS[2])
+			redis.call("HSET", KEYS[1] .. ":Q", KEYS[2], KEYS[4])
+			redis.call("HINCRBY", KEYS[1] .. ":Q", "bytes", #KEYS[4])
+			local fields = {":rc", ":fr", ":exp", ":meta"}
+			for i = 1, #fields do
+				if KEYS[i + 4] ~= "" then
+					redis.call("HSET", KEYS[1] .. ":Q", KEYS[2] .. fields[i], KEYS[i + 4])
+				end
+			end
+			return 1`
+
+// scriptRemoveMessages removes messages from queue KEYS[1] without counting them as deleted, KEYS[2..] are groups of
+// id, score, rc and body. A message is only removed while its score, rc and body are the ones given,
+// the IDs of messages which were not removed are returned.
+const scriptRemoveMessages = scriptMessages + `local kept = {}
+			for i = 2, #KEYS, 4 do
+				local id = KEYS[i]
+				local score = redis.call("ZSCORE", KEYS[1], id)
+				local m = redis.call("HMGET", KEYS[1] .. ":Q", id, id .. ":rc")
+				if score and tonumber(score) == tonumber(KEYS[i + 1]) and (tonumber(m[2]) or 0) == tonumber(KEYS[i + 2]) and m[1] == KEYS[i + 3] then
+					remove(KEYS[1], id)
+				else
+					table.insert(kept, id)
+				end
+			end
+			return kept`
+
+// scriptDropEmptyQueue deletes queue KEYS[1] named KEYS[3] from the QUEUES set KEYS[2], only when it has no messages.
+const scriptDropEmptyQueue = `if redis.call("ZCARD", KEYS[1]) > 0 then
+				return 0
+			end
+			redis.call("DEL", KEYS[1], KEYS[1] .. ":Q", KEYS[1] .. ":RL")
+			redis.call("SREM", KEYS[2], KEYS[3])
+			return 1`
+
+// scriptCountBytes sets the bytes counter of queue KEYS[1] to the size of the message bodies on it, and returns it.
+// Messages sent before the counter was kept are not counted in it until this runs.
+const scriptCountBytes = `local msgs = redis.call("ZRANGE", KEYS[1], 0, -1)
+			local bytes = 0
+			for i = 1, #msgs do
+				bytes = bytes + redis.call("HSTRLEN", KEYS[1] .. ":Q", msgs[i])
+			end
+			redis.call("HSET", KEYS[1] .. ":Q", "bytes", bytes)
+			return bytes`
+
+// scriptUpgradeQueue sets created KEYS[3], modified KEYS[4] and delay KEYS[5] on the queue hash KEYS[1],
+// only while its created time is still KEYS[2], so a queue converted by someone else is not converted twice.
+const scriptUpgradeQueue = `if redis.call("HGET", KEYS[1], "created") ~= KEYS[2] then
+				return 0
+			end
+			redis.call("HSET", KEYS[1], "created", KEYS[3], "modified", KEYS[4], "delay", KEYS[5])
+			return 1`
+
+// the scripts are run with EVALSHA, falling back to EVAL when the server does not have them cached
+var (
+	popMessageScript         = redis.NewScript(scriptPopMessage)
+	receiveMessageScript     = redis.NewScript(scriptReceiveMessage)
+	hideMessageScript        = redis.NewScript(scriptChangeMessageVisibility)
+	cancelMessageScript      = redis.NewScript(scriptCancelScheduledMessage)
+	peekMessagesScript       = redis.NewScript(scriptPeekMessages)
+	purgeQueueScript         = redis.NewScript(scriptPurgeQueue)
+	moveMessageScript        = redis.NewScript(scriptMoveMessage)
+	expireMessagesScript     = redis.NewScript(scriptExpireMessages)
+	removeOrphanFieldsScript = redis.NewScript(scriptRemoveOrphanFields)
+	removeBodilessScript     = redis.NewScript(scriptRemoveBodiless)
+	sendMessageScript        = redis.NewScript(scriptSendMessage)
+	deleteMessageScript      = redis.NewScript(scriptDeleteMessage)
+	queueStatsScript         = redis.NewScript(scriptQueueStats)
+	importMessageScript      = redis.NewScript(scriptImportMessage)
+	removeMessagesScript     = redis.NewScript(scriptRemoveMessages)
+	dropEmptyQueueScript     = redis.NewScript(scriptDropEmptyQueue)
+	countBytesScript         = redis.NewScript(scriptCountBytes)
+	upgradeQueueScript       = redis.NewScript(scriptUpgradeQueue)
+)
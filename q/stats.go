@@ -0,0 +1,119 @@
+package q
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type GetQueueStatsOptions struct {
+	QName string
+	// MaxScan is the most messages inspected, in the order they become visible. Defaults to DefaultStatsMaxScan
+	MaxScan int64
+}
+
+// DefaultStatsMaxScan is the most messages GetQueueStats inspects when no MaxScan is given.
+// The scan runs in a single script which blocks redis while it runs, so it is kept short
+const DefaultStatsMaxScan = 1000
+
+// QueueStats breaks down the messages on a queue by their state.
+// Messages and Visible are always exact, the other counts cover the first Scanned messages
+// so they are a lower bound when Scanned is less than Messages.
+type QueueStats struct {
+	Messages int64
+	Visible  int64
+	Delayed  int64
+	InFlight int64
+	Scanned  int64
+	// OldestVisibleAge is the time since the oldest visible message was sent, or 0 when no message is visible.
+	// Messages with IDs which do not hold the time they were sent, e.g. from the nodejs implementation,
+	// count from when they became visible instead, which is a lower bound of their age
+	OldestVisibleAge time.Duration
+	// ReceiveCounts maps a receive count to the number of messages which were received that many times,
+	// messages which keep being received without being deleted are likely poison messages
+	ReceiveCounts map[int64]int64
+}
+
+// Complete is true when every message on the queue was scanned
+func (s QueueStats) Complete() bool {
+	return s.Scanned >= s.Messages
+}
+
+// MaxReceiveCount is the highest receive count of any scanned message
+func (s QueueStats) MaxReceiveCount() int64 {
+	var max int64
+	for rc := range s.ReceiveCounts {
+		if rc > max {
+			max = rc
+		}
+	}
+	return max
+}
+
+func (s QueueStats) String() string {
+	marshal, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("Could not marshal QueueStats: %s", err)
+	}
+	return string(marshal)
+}
+
+// GetQueueStats counts the delayed and in-flight messages, which GetQueueAttributes reports together as HiddenMessages,
+// along with the age of the oldest visible message and the distribution of receive counts.
+// It runs as a single script so the counts are consistent with each other.
+func (rsmq *RedisSMQ) GetQueueStats(ctx context.Context, options GetQueueStatsOptions) (*QueueStats, error) {
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return nil, err
+	}
+	maxScan := options.MaxScan
+	if maxScan <= 0 {
+		maxScan = DefaultStatsMaxScan
+	}
+	args := []string{rsmq.ns + ":" + options.QName, q.timeSentUnix(), strconv.FormatInt(maxScan, 10)}
+	res, err := queueStatsScript.Run(ctx, rsmq.cl, args).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("eval queueStatsScript: %w", err)
+	}
+	if len(res) < 7 || len(res)%2 != 1 {
+		return nil, fmt.Errorf("GetQueueStats: unexpected result length %d", len(res))
+	}
+	counts := make([]int64, 5)
+	for i := range counts {
+		n, ok := res[i].(int64)
+		if !ok {
+			return nil, fmt.Errorf("GetQueueStats: unexpected count %v", res[i])
+		}
+		counts[i] = n
+	}
+	stats := &QueueStats{
+		Messages:      counts[0],
+		Visible:       counts[1],
+		Delayed:       counts[2],
+		InFlight:      counts[3],
+		Scanned:       counts[4],
+		ReceiveCounts: map[int64]int64{},
+	}
+	if oldest, _ := res[5].(string); oldest != "" {
+		if sent := SentFromID(oldest); !sent.IsZero() && sent.Before(q.TimeSent) {
+			stats.OldestVisibleAge = q.TimeSent.Sub(sent)
+		}
+	}
+	if since, _ := res[6].(string); since != "" {
+		ms, err := strconv.ParseFloat(since, 64)
+		if err != nil {
+			return nil, fmt.Errorf("GetQueueStats: parse score %q: %w", since, err)
+		}
+		if age := q.TimeSent.Sub(time.UnixMilli(int64(ms))); age > stats.OldestVisibleAge {
+			stats.OldestVisibleAge = age
+		}
+	}
+	for i := 7; i < len(res); i += 2 {
+		rc, _ := res[i].(int64)
+		n, _ := res[i+1].(int64)
+		stats.ReceiveCounts[rc] = n
+	}
+	return stats, nil
+}
@@ -0,0 +1,88 @@
+package q
+
+import (
+	"github.com/go-redis/redis/v8"
+	"testing"
+	"time"
+)
+
+func TestGetQueueStats(t *testing.T) {
+	qName, q, ctx, err := newQ("TestGetQueueStats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "in flight"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// receive the message twice, the second time leaving it in flight
+	vt := 0
+	for i := 0; i < 2; i++ {
+		_, err = q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName, VisibilityTimeout: &vt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vt = 30
+		time.Sleep(2 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "visible"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "delayed", DeliverAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	stats, err := q.GetQueueStats(ctx, GetQueueStatsOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 4 || stats.Visible != 2 || stats.Delayed != 1 || stats.InFlight != 1 || !stats.Complete() {
+		t.Fatalf("expected 4 messages, 2 visible, 1 delayed and 1 in flight but got %s", stats)
+	}
+	if stats.ReceiveCounts[0] != 3 || stats.ReceiveCounts[2] != 1 || stats.MaxReceiveCount() != 2 {
+		t.Fatalf("expected 3 messages never received and 1 received twice but got %v", stats.ReceiveCounts)
+	}
+	if stats.OldestVisibleAge < 10*time.Millisecond {
+		t.Fatalf("expected the oldest visible message to be at least 10ms old but got %s", stats.OldestVisibleAge)
+	}
+
+	stats, err = q.GetQueueStats(ctx, GetQueueStatsOptions{QName: qName, MaxScan: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 2 || stats.Complete() || stats.Messages != 4 {
+		t.Fatalf("expected to scan 2 of 4 messages but got %s", stats)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
+
+func TestGetQueueStatsLegacyIDs(t *testing.T) {
+	qName, q, ctx, err := newQ("TestGetQueueStatsLegacyIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	// a message with a 22 character ID, as older versions and the nodejs implementation make them, visible for a minute
+	key := q.ns + ":" + qName
+	id := makeUID(22)
+	if err := q.cl.ZAdd(ctx, key, &redis.Z{Score: float64(time.Now().Add(-time.Minute).UnixMilli()), Member: id}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.cl.HSet(ctx, key+":Q", id, "legacy").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := q.GetQueueStats(ctx, GetQueueStatsOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Visible != 1 || stats.OldestVisibleAge < time.Minute {
+		t.Fatalf("expected the legacy message to be at least a minute old but got %s", stats)
+	}
+}
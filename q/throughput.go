@@ -0,0 +1,84 @@
+package q
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+// throughputRetention is how long the per minute throughput buckets are kept, in seconds.
+// It is a little over a day so that a full day can always be charted.
+const throughputRetention = "90000"
+
+type GetQueueThroughputOptions struct {
+	QName string
+	// Since is the start of the first bucket, it is limited to the last day
+	Since time.Time
+	// Resolution is the width of each bucket, it is rounded to a whole number of minutes. Defaults to 1 minute
+	Resolution time.Duration
+}
+
+// ThroughputBucket counts the messages sent to, received from and deleted from a queue during [Start, Start+Resolution)
+type ThroughputBucket struct {
+	Start    time.Time
+	Sent     int64
+	Received int64
+	Deleted  int64
+}
+
+// GetQueueThroughput returns the throughput of the queue from Since until now, oldest bucket first.
+// Buckets are aligned to multiples of the Resolution and the last bucket is still being filled.
+func (rsmq *RedisSMQ) GetQueueThroughput(ctx context.Context, options GetQueueThroughputOptions) ([]ThroughputBucket, error) {
+	q, err := rsmq.getQueue(ctx, options.QName)
+	if err != nil {
+		return nil, err
+	}
+	resolution := options.Resolution.Truncate(time.Minute)
+	if resolution <= 0 {
+		resolution = time.Minute
+	}
+	now := q.TimeSent
+	since := options.Since
+	if oldest := now.Add(-24 * time.Hour); since.Before(oldest) {
+		since = oldest
+	}
+	since = since.Truncate(resolution)
+	if since.After(now) {
+		return nil, nil
+	}
+
+	key := rsmq.ns + ":" + options.QName + ":TP:"
+	first := since.Unix() / 60
+	last := now.Unix() / 60
+	pipe := rsmq.cl.Pipeline()
+	counts := make([]*redis.SliceCmd, 0, last-first+1)
+	for m := first; m <= last; m++ {
+		counts = append(counts, pipe.HMGet(ctx, key+strconv.FormatInt(m, 10), "sent", "recv", "del"))
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetQueueThroughput: %w", err)
+	}
+
+	var buckets []ThroughputBucket
+	for i, count := range counts {
+		start := time.Unix((first+int64(i))*60, 0).Truncate(resolution)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+			buckets = append(buckets, ThroughputBucket{Start: start})
+		}
+		b := &buckets[len(buckets)-1]
+		vals := count.Val()
+		b.Sent += parseCount(vals[0])
+		b.Received += parseCount(vals[1])
+		b.Deleted += parseCount(vals[2])
+	}
+	return buckets, nil
+}
+
+func parseCount(v interface{}) int64 {
+	s, _ := v.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,62 @@
+package q
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetQueueThroughput(t *testing.T) {
+	qName, q, ctx, err := newQ("TestGetQueueThroughput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := q.SendMessage(ctx, SendMessageRequestOptions{QName: qName, Message: "counted"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.PopMessage(ctx, PopMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.DeleteMessage(ctx, DeleteMessageRequest{QName: qName, ID: message.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deleting a message which is already gone is not counted
+	err = q.DeleteMessage(ctx, DeleteMessageRequest{QName: qName, ID: message.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, err := q.GetQueueThroughput(ctx, GetQueueThroughputOptions{
+		QName:      qName,
+		Since:      time.Now().Add(-time.Hour),
+		Resolution: 10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) < 6 || len(buckets) > 7 {
+		t.Fatalf("expected an hour of 10 minute buckets but got %d", len(buckets))
+	}
+	var total ThroughputBucket
+	for i, b := range buckets {
+		if b.Start.Unix()%600 != 0 || (i > 0 && b.Start.Sub(buckets[i-1].Start) != 10*time.Minute) {
+			t.Fatalf("expected buckets aligned to 10 minutes but got %s", b.Start)
+		}
+		total.Sent += b.Sent
+		total.Received += b.Received
+		total.Deleted += b.Deleted
+	}
+	if total.Sent != 3 || total.Received != 2 || total.Deleted != 1 {
+		t.Fatalf("expected 3 sent, 2 received and 1 deleted but got %+v", total)
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
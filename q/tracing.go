@@ -0,0 +1,51 @@
+package q
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ebuckley/rsmq/q"
+
+func (rsmq *RedisSMQ) startSendSpan(ctx context.Context, qname string) (context.Context, trace.Span) {
+	return rsmq.tracer.Start(ctx, qname+" send",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rsmq"),
+			attribute.String("messaging.destination", qname),
+		))
+}
+
+// injectMetadata returns a copy of metadata with the trace context of ctx added
+func (rsmq *RedisSMQ) injectMetadata(ctx context.Context, metadata map[string]string) map[string]string {
+	carrier := propagation.MapCarrier{}
+	for k, v := range metadata {
+		carrier[k] = v
+	}
+	rsmq.propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// StartProcessSpan starts a consumer span for processing msg, linked to the span which sent it.
+// The caller must End the span once the message has been handled.
+func (rsmq *RedisSMQ) StartProcessSpan(ctx context.Context, qname string, msg *Message) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rsmq"),
+			attribute.String("messaging.destination", qname),
+			attribute.String("messaging.message_id", msg.ID),
+			attribute.Int64("messaging.rsmq.rc", msg.RC),
+		),
+	}
+	producer := trace.SpanContextFromContext(rsmq.propagator.Extract(context.Background(), propagation.MapCarrier(msg.Metadata)))
+	if producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	return rsmq.tracer.Start(ctx, qname+" process", opts...)
+}
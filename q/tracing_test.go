@@ -0,0 +1,61 @@
+package q
+
+import (
+	"context"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestTracePropagation(t *testing.T) {
+	ctx := context.Background()
+	cl, err := testClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	q, err := New(ctx, Options{Client: cl, TracerProvider: tp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qName := "TestTracePropagation" + makeUID(4)
+	err = q.CreateQueue(ctx, CreateQueueRequestOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = q.SendMessage(ctx, SendMessageRequestOptions{
+		QName:    qName,
+		Message:  "traced",
+		Metadata: map[string]string{"tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := q.ReceiveMessage(ctx, ReceiveMessageOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Metadata["tenant"] != "acme" || message.Metadata["traceparent"] == "" {
+		t.Fatalf("expected the metadata and trace context to be received but got %v", message.Metadata)
+	}
+
+	_, span := q.StartProcessSpan(ctx, qName, message)
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected a send and a process span but got %d", len(spans))
+	}
+	send, process := spans[0], spans[1]
+	if send.SpanKind != trace.SpanKindProducer || process.SpanKind != trace.SpanKindConsumer {
+		t.Fatalf("expected producer and consumer spans but got %s and %s", send.SpanKind, process.SpanKind)
+	}
+	if len(process.Links) != 1 || process.Links[0].SpanContext.SpanID() != send.SpanContext.SpanID() {
+		t.Fatal("expected the process span to be linked to the send span")
+	}
+
+	_ = q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+}
@@ -0,0 +1,74 @@
+package q
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// UpgradeQueues converts the queues written by versions of this package which counted the queue delay in milliseconds.
+// Those queues hold an RFC3339 created time, which is how they are told apart, their delay is rounded up to whole seconds
+// and their created and modified times become unix seconds, as the nodejs implementation stores them.
+// Converted queues are left alone, so it is safe to run more than once. It returns the names of the queues it converted
+func (rsmq *RedisSMQ) UpgradeQueues(ctx context.Context) ([]string, error) {
+	qnames, err := rsmq.ListQueues(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("UpgradeQueues: %w", err)
+	}
+	var upgraded []string
+	for _, qname := range qnames {
+		ok, err := rsmq.upgradeQueue(ctx, qname)
+		if err != nil {
+			return upgraded, fmt.Errorf("UpgradeQueues: %s: %w", qname, err)
+		}
+		if ok {
+			upgraded = append(upgraded, qname)
+		}
+	}
+	return upgraded, nil
+}
+
+// upgradeQueue converts qname when it was written with a delay in milliseconds, and reports whether it did
+func (rsmq *RedisSMQ) upgradeQueue(ctx context.Context, qname string) (bool, error) {
+	key := rsmq.ns + ":" + qname + ":Q"
+	fields, err := rsmq.cl.HMGet(ctx, key, "created", "modified", "delay").Result()
+	if err != nil {
+		return false, err
+	}
+	created, _ := fields[0].(string)
+	if _, err := strconv.ParseInt(created, 10, 64); err == nil || len(created) == 0 {
+		return false, nil
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return false, fmt.Errorf("parse created %q: %w", created, err)
+	}
+	// modified is unix seconds once the queue was changed by a newer version
+	modified, _ := fields[1].(string)
+	modifiedUnix, err := strconv.ParseInt(modified, 10, 64)
+	if err != nil {
+		modifiedAt, err := time.Parse(time.RFC3339Nano, modified)
+		if err != nil {
+			modifiedAt = createdAt
+		}
+		modifiedUnix = modifiedAt.Unix()
+	}
+	delay, _ := fields[2].(string)
+	ms, err := strconv.ParseInt(delay, 10, 64)
+	if err != nil && len(delay) > 0 {
+		return false, fmt.Errorf("parse delay %q: %w", delay, err)
+	}
+	args := []string{
+		key,
+		created,
+		strconv.FormatInt(createdAt.Unix(), 10),
+		strconv.FormatInt(modifiedUnix, 10),
+		strconv.FormatInt((ms+999)/1000, 10),
+	}
+	n, err := upgradeQueueScript.Run(ctx, rsmq.cl, args).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
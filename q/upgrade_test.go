@@ -0,0 +1,53 @@
+package q
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUpgradeQueues(t *testing.T) {
+	qName, q, ctx, err := newQ("TestUpgradeQueues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.DeleteQueue(ctx, DeleteQueueRequestOptions{QName: qName})
+	// the fields as versions which counted the delay in milliseconds wrote them
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = q.cl.HSet(ctx, q.ns+":"+qName+":Q", "created", created.Format(time.RFC3339Nano), "modified", created.Format(time.RFC3339Nano), "delay", 1500).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgraded, err := q.UpgradeQueues(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range upgraded {
+		found = found || name == qName
+	}
+	if !found {
+		t.Fatalf("expected %s to be upgraded but got %v", qName, upgraded)
+	}
+	attrs, err := q.GetQueueAttributes(ctx, GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.DelayForMessages != 2 {
+		t.Fatalf("expected the 1500ms delay to be rounded up to 2 seconds but got %d", attrs.DelayForMessages)
+	}
+	if want := strconv.FormatInt(created.Unix(), 10); attrs.Created != want || attrs.Modified != want {
+		t.Fatalf("expected created and modified to be %s but got %s and %s", want, attrs.Created, attrs.Modified)
+	}
+
+	upgraded, err = q.UpgradeQueues(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range upgraded {
+		if name == qName {
+			t.Fatal("expected an upgraded queue to be left alone")
+		}
+	}
+}
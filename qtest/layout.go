@@ -0,0 +1,185 @@
+package qtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/go-redis/redis/v8"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nodeID is the format of message IDs made by the nodejs implementation,
+// the send time in base36 microseconds followed by 22 random characters
+var nodeID = regexp.MustCompile(`^[0-9a-z]{10}[0-9a-zA-Z]{22}$`)
+
+// RunNodeLayout checks that q.RedisSMQ stores queues in ns with the same keys, fields and units as the
+// nodejs implementation github.com/smrchy/rsmq, so both can work on the same queues.
+func RunNodeLayout(t *testing.T, cl *redis.Client, ns string) {
+	ctx := context.Background()
+	mq, err := q.New(ctx, q.Options{Client: cl, NameSpace: &ns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qname := fmt.Sprintf("layout%d", rand.Int63())
+	key := ns + ":" + qname
+	defer mq.DeleteQueue(ctx, q.DeleteQueueRequestOptions{QName: qname})
+
+	serverTime := func() time.Time {
+		now, err := cl.Time(ctx).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+	near := func(name string, got int64, want int64, tolerance int64) {
+		t.Helper()
+		if got < want-tolerance || got > want+tolerance {
+			t.Fatalf("expected %s to be about %d but got %d", name, want, got)
+		}
+	}
+	intField := func(hkey string, field string) int64 {
+		t.Helper()
+		v, err := cl.HGet(ctx, hkey, field).Result()
+		if err != nil {
+			t.Fatalf("HGET %s %s: %s", hkey, field, err)
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			t.Fatalf("expected %s %s to be an integer but got %q", hkey, field, v)
+		}
+		return n
+	}
+	keyType := func(k string, want string) {
+		t.Helper()
+		got, err := cl.Type(ctx, k).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("expected %s to be a %s but it is a %s", k, want, got)
+		}
+	}
+
+	t.Run("CreateQueue", func(t *testing.T) {
+		err := mq.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyType(ns+":QUEUES", "set")
+		if ok, _ := cl.SIsMember(ctx, ns+":QUEUES", qname).Result(); !ok {
+			t.Fatalf("expected %s to be a member of %s:QUEUES", qname, ns)
+		}
+		keyType(key+":Q", "hash")
+		near("vt", intField(key+":Q", "vt"), 30, 0)
+		near("delay", intField(key+":Q", "delay"), 0, 0)
+		near("maxsize", intField(key+":Q", "maxsize"), 65536, 0)
+		now := serverTime().Unix()
+		// created and modified are unix seconds
+		near("created", intField(key+":Q", "created"), now, 5)
+		near("modified", intField(key+":Q", "modified"), now, 5)
+	})
+
+	var id string
+	t.Run("SendMessage", func(t *testing.T) {
+		id, err = mq.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "layout"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nodeID.MatchString(id) {
+			t.Fatalf("expected a nodejs style message ID but got %s", id)
+		}
+		now := serverTime()
+		us, _ := strconv.ParseInt(id[:10], 36, 64)
+		near("the ID timestamp", us, now.UnixMicro(), 5000000)
+		keyType(key, "zset")
+		// scores are milliseconds
+		score, err := cl.ZScore(ctx, key, id).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		near("the score", int64(score), now.UnixMilli(), 5000)
+		body, err := cl.HGet(ctx, key+":Q", id).Result()
+		if err != nil || body != "layout" {
+			t.Fatalf("expected the body in the %s field of %s:Q but got %q %v", id, key, body, err)
+		}
+		near("totalsent", intField(key+":Q", "totalsent"), 1, 0)
+	})
+
+	t.Run("ReceiveMessage", func(t *testing.T) {
+		msg, err := mq.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil || msg.ID != id {
+			t.Fatalf("expected to receive %s but got %s", id, msg)
+		}
+		now := serverTime().UnixMilli()
+		near("rc", intField(key+":Q", id+":rc"), 1, 0)
+		near("fr", intField(key+":Q", id+":fr"), now, 5000)
+		near("totalrecv", intField(key+":Q", "totalrecv"), 1, 0)
+		score, err := cl.ZScore(ctx, key, id).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		near("the score after receive", int64(score), now+30000, 5000)
+	})
+
+	t.Run("DeleteMessage", func(t *testing.T) {
+		err := mq.DeleteMessage(ctx, q.DeleteMessageRequest{QName: qname, ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := cl.ZCard(ctx, key).Result()
+		if err != nil || n != 0 {
+			t.Fatalf("expected %s to be empty but got %d %v", key, n, err)
+		}
+		fields, err := cl.HKeys(ctx, key+":Q").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range fields {
+			if strings.HasPrefix(f, id) {
+				t.Fatalf("expected the fields of %s to be deleted but found %s", id, f)
+			}
+		}
+	})
+
+	t.Run("QueueDelay", func(t *testing.T) {
+		delay := 60
+		_, err := mq.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, DelayForMessages: &delay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		near("delay", intField(key+":Q", "delay"), 60, 0)
+		delayed, err := mq.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "delayed"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mq.DeleteMessage(ctx, q.DeleteMessageRequest{QName: qname, ID: delayed})
+		// the delay is in seconds, so the message is scored a minute ahead
+		score, err := cl.ZScore(ctx, key, delayed).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		near("the score of a delayed message", int64(score), serverTime().UnixMilli()+60000, 5000)
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		keys, err := cl.Keys(ctx, key+"*").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			suffix := strings.TrimPrefix(k, key)
+			// the throughput buckets and rate limit bucket are extensions which nodejs ignores
+			if suffix != "" && suffix != ":Q" && suffix != ":RL" && !strings.HasPrefix(suffix, ":TP:") {
+				t.Fatalf("unexpected key %s", k)
+			}
+		}
+	})
+}
@@ -0,0 +1,437 @@
+package qtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Backend is a queue implementation under test
+type Backend struct {
+	Queue q.Queue
+	// Now is the current time of the queue
+	Now func() time.Time
+	// Wait lets time pass, implementations with a Clock option can use Clock.Advance instead of sleeping
+	Wait func(d time.Duration)
+}
+
+// RealTime makes a Backend for an implementation which uses the system clock
+func RealTime(queue q.Queue) Backend {
+	return Backend{Queue: queue, Now: time.Now, Wait: time.Sleep}
+}
+
+// Clock is a manually advanced clock for implementations with a Clock option
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// cases are the conformance checks, each is run against a new Backend with an empty queue named qname.
+// Backends can hold other queues, so cases only delete the queues they create, see createQueue
+var cases = []struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, b Backend, qname string)
+}{
+	{"CreateListDelete", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		attrs, err := b.Queue.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.VisibilityTimeout != 30 || attrs.DelayForMessages != 0 || attrs.MaxSizeBytes != 65536 || attrs.CurrentN != 0 {
+			t.Fatalf("expected the default attributes but got %s", attrs)
+		}
+		queues, err := b.Queue.ListQueues(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !contains(queues, qname) {
+			t.Fatalf("expected %s to be listed but got %v", qname, queues)
+		}
+		err = b.Queue.DeleteQueue(ctx, q.DeleteQueueRequestOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = b.Queue.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+		if err != q.QueueNotFoundError {
+			t.Fatalf("expected QueueNotFoundError after delete but got %v", err)
+		}
+		queues, err = b.Queue.ListQueues(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contains(queues, qname) {
+			t.Fatalf("expected %s not to be listed after delete but got %v", qname, queues)
+		}
+	}},
+	{"SendReceive", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		sentAt := b.Now()
+		id := send(t, ctx, b, qname, "hello")
+		msg := receive(t, ctx, b, qname, nil)
+		if msg == nil || msg.ID != id || msg.Message != "hello" || msg.RC != 1 {
+			t.Fatalf("expected to receive %s once but got %s", id, msg)
+		}
+		if d := msg.FR.Sub(sentAt); d < -time.Second || d > time.Second {
+			t.Fatalf("expected FR to be the time of the receive but got %s", msg.FR)
+		}
+		if d := msg.Sent.Sub(sentAt); d < -time.Second || d > time.Second {
+			t.Fatalf("expected Sent to be the time of the send but got %s", msg.Sent)
+		}
+		if msg.Deadline == nil || msg.Deadline.Sub(msg.FR) < 29*time.Second {
+			t.Fatalf("expected the deadline to be the visibility timeout after the receive but got %v", msg.Deadline)
+		}
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the received message to be hidden but got %s", msg)
+		}
+		attrs, err := b.Queue.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.CurrentN != 1 || attrs.HiddenMessages != 1 || attrs.TotalSent != 1 || attrs.TotalReceived != 1 || attrs.CurrentBytes != 5 {
+			t.Fatalf("expected 1 hidden message sent and received once but got %s", attrs)
+		}
+	}},
+	{"VisibilityTimeout", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		id := send(t, ctx, b, qname, "retry")
+		vt := 1
+		first := receive(t, ctx, b, qname, &vt)
+		b.Wait(1100 * time.Millisecond)
+		second := receive(t, ctx, b, qname, nil)
+		if second == nil || second.ID != id || second.RC != 2 {
+			t.Fatalf("expected %s to be received a second time but got %s", id, second)
+		}
+		if !second.FR.Equal(first.FR) {
+			t.Fatalf("expected FR to stay %s but got %s", first.FR, second.FR)
+		}
+	}},
+	{"ChangeMessageVisibility", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		ok, err := b.Queue.ChangeMessageVisibility(ctx, q.ChangeMessageVisibilityOptions{QName: qname, ID: "missing", VisibilityTimeout: 10})
+		if err != nil || ok {
+			t.Fatalf("expected false for a missing message but got %v %v", ok, err)
+		}
+		id := send(t, ctx, b, qname, "change")
+		ok, err = b.Queue.ChangeMessageVisibility(ctx, q.ChangeMessageVisibilityOptions{QName: qname, ID: id, VisibilityTimeout: 10})
+		if err != nil || !ok {
+			t.Fatalf("expected to hide %s but got %v %v", id, ok, err)
+		}
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the message to be hidden but got %s", msg)
+		}
+		ok, err = b.Queue.ChangeMessageVisibility(ctx, q.ChangeMessageVisibilityOptions{QName: qname, ID: id, VisibilityTimeout: 0})
+		if err != nil || !ok {
+			t.Fatalf("expected to show %s but got %v %v", id, ok, err)
+		}
+		b.Wait(10 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg == nil || msg.ID != id || msg.RC != 1 {
+			t.Fatalf("expected to receive %s but got %s", id, msg)
+		}
+	}},
+	{"DeleteMessage", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		first := send(t, ctx, b, qname, "first")
+		second := send(t, ctx, b, qname, "second")
+		err := b.Queue.DeleteMessage(ctx, q.DeleteMessageRequest{QName: qname, ID: first})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := receive(t, ctx, b, qname, nil); msg == nil || msg.ID != second {
+			t.Fatalf("expected to receive %s but got %s", second, msg)
+		}
+		err = b.Queue.DeleteMessage(ctx, q.DeleteMessageRequest{QName: qname})
+		if err == nil {
+			t.Fatal("expected an error deleting without an ID")
+		}
+	}},
+	{"PopMessage", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		id := send(t, ctx, b, qname, "pop")
+		msg, err := b.Queue.PopMessage(ctx, q.PopMessageOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil || msg.ID != id || msg.RC != 1 {
+			t.Fatalf("expected to pop %s but got %s", id, msg)
+		}
+		msg, err = b.Queue.PopMessage(ctx, q.PopMessageOptions{QName: qname})
+		if err != nil || msg != nil {
+			t.Fatalf("expected nothing to pop but got %s %v", msg, err)
+		}
+		attrs, err := b.Queue.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.CurrentN != 0 || attrs.TotalReceived != 1 || attrs.CurrentBytes != 0 {
+			t.Fatalf("expected an empty queue received from once but got %s", attrs)
+		}
+	}},
+	{"Order", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		var ids []string
+		for i := 0; i < 3; i++ {
+			ids = append(ids, send(t, ctx, b, qname, fmt.Sprint(i)))
+			b.Wait(2 * time.Millisecond)
+		}
+		for _, id := range ids {
+			if msg := receive(t, ctx, b, qname, nil); msg == nil || msg.ID != id {
+				t.Fatalf("expected to receive %s next but got %s", id, msg)
+			}
+		}
+	}},
+	{"DeliverAt", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		id, err := b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "later", DeliverAt: b.Now().Add(time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the message to be delayed but got %s", msg)
+		}
+		b.Wait(1100 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg == nil || msg.ID != id {
+			t.Fatalf("expected to receive %s once delivered but got %s", id, msg)
+		}
+	}},
+	{"QueueDelay", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		// the delay is in seconds
+		delay := 1
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, DelayForMessages: &delay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := send(t, ctx, b, qname, "delayed")
+		b.Wait(500 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the message to be delayed but got %s", msg)
+		}
+		b.Wait(600 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg == nil || msg.ID != id {
+			t.Fatalf("expected to receive %s once the delay passed but got %s", id, msg)
+		}
+	}},
+	{"MessageDelay", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		delay := 60
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, DelayForMessages: &delay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the message delay replaces the longer queue delay
+		id, err := b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "soon", Delay: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the message to be delayed but got %s", msg)
+		}
+		b.Wait(1100 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg == nil || msg.ID != id {
+			t.Fatalf("expected to receive %s once its delay passed but got %s", id, msg)
+		}
+	}},
+	{"MaxSize", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		size := int64(5)
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, Maxsize: &size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "123456"})
+		if err == nil {
+			t.Fatal("expected an error sending a message over the max size")
+		}
+		send(t, ctx, b, qname, "12345")
+	}},
+	{"QueueFull", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		max := int64(1)
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, MaxMessages: &max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		send(t, ctx, b, qname, "only")
+		_, err = b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "one too many"})
+		if !errors.Is(err, q.QueueFullError) {
+			t.Fatalf("expected QueueFullError but got %v", err)
+		}
+	}},
+	{"SetQueueAttributes", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		vt, delay, size := 15, 20, int64(256)
+		attrs, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, VisibilityTimeout: &vt, DelayForMessages: &delay, Maxsize: &size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.VisibilityTimeout != vt || attrs.DelayForMessages != delay || attrs.MaxSizeBytes != size {
+			t.Fatalf("expected the new attributes but got %s", attrs)
+		}
+		_, err = b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname})
+		if err == nil {
+			t.Fatal("expected an error when no attribute is set")
+		}
+		_, err = b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, DeadLetterQueue: &qname})
+		if err == nil {
+			t.Fatal("expected an error when the queue is its own dead letter queue")
+		}
+		_, err = b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname + "-missing", VisibilityTimeout: &vt})
+		if !errors.Is(err, q.QueueNotFoundError) {
+			t.Fatalf("expected QueueNotFoundError but got %v", err)
+		}
+	}},
+	{"QueueNotFound", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		missing := qname + "-missing"
+		_, err := b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: missing, Message: "nowhere"})
+		if !errors.Is(err, q.QueueNotFoundError) {
+			t.Fatalf("send: expected QueueNotFoundError but got %v", err)
+		}
+		_, err = b.Queue.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: missing})
+		if !errors.Is(err, q.QueueNotFoundError) {
+			t.Fatalf("receive: expected QueueNotFoundError but got %v", err)
+		}
+		_, err = b.Queue.PopMessage(ctx, q.PopMessageOptions{QName: missing})
+		if !errors.Is(err, q.QueueNotFoundError) {
+			t.Fatalf("pop: expected QueueNotFoundError but got %v", err)
+		}
+		_, err = b.Queue.ChangeMessageVisibility(ctx, q.ChangeMessageVisibilityOptions{QName: missing, ID: "id"})
+		if !errors.Is(err, q.QueueNotFoundError) {
+			t.Fatalf("change visibility: expected QueueNotFoundError but got %v", err)
+		}
+	}},
+	{"ExpireToDeadLetterQueue", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		dlq := qname + "-dlq"
+		createQueue(t, ctx, b, dlq)
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, DeadLetterQueue: &dlq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "short lived", TTL: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Wait(1100 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the message to have expired but got %s", msg)
+		}
+		if msg := receive(t, ctx, b, dlq, nil); msg == nil || msg.ID != id {
+			t.Fatalf("expected %s on the dead letter queue but got %s", id, msg)
+		}
+	}},
+	{"DeadLetterQueueFull", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		dlq := qname + "-dlq"
+		createQueue(t, ctx, b, dlq)
+		max := int64(1)
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: dlq, MaxMessages: &max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, DeadLetterQueue: &dlq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		send(t, ctx, b, dlq, "already dead")
+		_, err = b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: "short lived", TTL: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Wait(1100 * time.Millisecond)
+		if msg := receive(t, ctx, b, qname, nil); msg != nil {
+			t.Fatalf("expected the message to have expired but got %s", msg)
+		}
+		attrs, err := b.Queue.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.CurrentN != 0 || attrs.DeadLetterDropped != 1 {
+			t.Fatalf("expected the expired message to be dropped and counted but got %s", attrs)
+		}
+		attrs, err = b.Queue.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: dlq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.CurrentN != 1 {
+			t.Fatalf("expected the full dead letter queue to keep one message but got %s", attrs)
+		}
+	}},
+	{"RateLimit", func(t *testing.T, ctx context.Context, b Backend, qname string) {
+		rate := 1
+		_, err := b.Queue.SetQueueAttributes(ctx, q.SetAttributesOptions{QName: qname, MaxReceivesPerSecond: &rate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		send(t, ctx, b, qname, "first")
+		send(t, ctx, b, qname, "second")
+		receive(t, ctx, b, qname, nil)
+		_, err = b.Queue.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: qname})
+		var rateLimited *q.RateLimitError
+		if !errors.As(err, &rateLimited) || rateLimited.RetryAfter <= 0 || rateLimited.RetryAfter > time.Second {
+			t.Fatalf("expected a RateLimitError but got %v", err)
+		}
+	}},
+}
+
+// Run checks that the queue implementation made by newBackend behaves like q.RedisSMQ, running each case as a subtest.
+// newBackend is called once per case, the queues it holds are deleted when the case finishes
+func Run(t *testing.T, newBackend func(t *testing.T) Backend) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := newBackend(t)
+			// cleanups run last in first out, so the queues are deleted before the backend is closed
+			t.Cleanup(func() { _ = b.Queue.Close() })
+			qname := fmt.Sprintf("conformance-%s-%d", c.name, rand.Int63())
+			createQueue(t, ctx, b, qname)
+			c.run(t, ctx, b, qname)
+		})
+	}
+}
+
+// createQueue creates the queue and deletes it once the case is done
+func createQueue(t *testing.T, ctx context.Context, b Backend, qname string) {
+	t.Helper()
+	err := b.Queue.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = b.Queue.DeleteQueue(ctx, q.DeleteQueueRequestOptions{QName: qname})
+	})
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func send(t *testing.T, ctx context.Context, b Backend, qname string, body string) string {
+	t.Helper()
+	id, err := b.Queue.SendMessage(ctx, q.SendMessageRequestOptions{QName: qname, Message: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func receive(t *testing.T, ctx context.Context, b Backend, qname string, vt *int) *q.Message {
+	t.Helper()
+	msg, err := b.Queue.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: qname, VisibilityTimeout: vt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
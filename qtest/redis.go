@@ -0,0 +1,20 @@
+package qtest
+
+import (
+	"github.com/go-redis/redis/v8"
+	"os"
+	"testing"
+)
+
+// RedisClient connects to the redis server at REDIS_URL, or localhost when it is not set
+func RedisClient(t testing.TB) *redis.Client {
+	url := os.Getenv("REDIS_URL")
+	if len(url) == 0 {
+		url = "redis://localhost:6379"
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return redis.NewClient(opts)
+}
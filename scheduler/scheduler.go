@@ -0,0 +1,311 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/go-redis/redis/v8"
+	"github.com/robfig/cron/v3"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ScheduleNotFoundError = errors.New("Schedule Not Found")
+
+// Schedule is a recurring message which is sent to QName on every occurrence of Spec
+type Schedule struct {
+	// Name uniquely identifies the schedule within the namespace
+	Name string
+	// Spec is a standard 5 field cron expression, or a descriptor like @hourly or @every 5m
+	Spec string
+	// QName is the queue each occurrence is sent to
+	QName string
+	// Message is the contents of the message sent on each occurrence
+	Message string
+}
+
+func (s Schedule) String() string {
+	marshal, _ := json.Marshal(s)
+	return string(marshal)
+}
+
+type AddScheduleOptions struct {
+	Name    string
+	Spec    string
+	QName   string
+	Message string
+}
+
+type RemoveScheduleOptions struct {
+	Name string
+}
+
+// Scheduler is a distributed cron which enqueues each occurrence of a Schedule exactly once,
+// no matter how many replicas of the scheduler are running against the same namespace
+type Scheduler struct {
+	cl       *redis.Client
+	mq       *q.RedisSMQ
+	ns       string
+	interval time.Duration
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+type Options struct {
+	Client    *redis.Client
+	NameSpace *string
+	// Interval is how often schedules are checked for new occurrences, defaults to one second
+	Interval time.Duration
+}
+
+// New creates the Scheduler, sharing the redis client and namespace with the queues it sends to
+func New(ctx context.Context, opts Options) (*Scheduler, error) {
+	var cl *redis.Client
+	if opts.Client == nil {
+		cl = redis.NewClient(&redis.Options{
+			Addr:     "localhost:6379",
+			Password: "",
+			DB:       0,
+		})
+	} else {
+		cl = opts.Client
+	}
+	var ns string
+	if opts.NameSpace != nil {
+		ns = *opts.NameSpace
+	} else {
+		ns = "rsmq"
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	mq, err := q.New(ctx, q.Options{Client: cl, NameSpace: &ns})
+	if err != nil {
+		return nil, fmt.Errorf("scheduler: %w", err)
+	}
+	return &Scheduler{cl: cl, mq: mq, ns: ns, interval: interval, quit: make(chan struct{})}, nil
+}
+
+func (s *Scheduler) schedulesKey() string {
+	return s.ns + ":SCHEDULES"
+}
+
+// firedKey is the hash of the time each schedule has enqueued every occurrence up to, in unix milliseconds
+func (s *Scheduler) firedKey() string {
+	return s.schedulesKey() + ":FIRED"
+}
+
+// occurrenceKey is the marker claimed by the replica which enqueues the occurrence at t
+func (s *Scheduler) occurrenceKey(name string, t time.Time) string {
+	return s.schedulesKey() + ":" + name + ":" + strconv.FormatInt(t.Unix(), 10)
+}
+
+const (
+	// claimTTL is how long a replica holds an occurrence while it sends it,
+	// when the replica dies holding the claim another replica enqueues the occurrence once the claim runs out
+	claimTTL = time.Minute
+	// sentTTL is how long a sent occurrence is remembered, it outlives any window a lagging replica could still be processing
+	sentTTL = 24 * time.Hour
+	// maxCatchUp is the furthest back occurrences are enqueued after the scheduler was down or a schedule kept failing,
+	// older occurrences are skipped. It is well within sentTTL, so no occurrence it covers can be sent twice
+	maxCatchUp = time.Hour
+)
+
+// advanceScript moves a schedule on to KEYS[3] in the hash KEYS[1], it never moves one back
+var advanceScript = redis.NewScript(`local fired = tonumber(redis.call("HGET", KEYS[1], KEYS[2])) or 0
+			if tonumber(KEYS[3]) > fired then
+				redis.call("HSET", KEYS[1], KEYS[2], KEYS[3])
+			end
+			return 0`)
+
+// AddSchedule stores the schedule, replacing any existing schedule with the same name.
+// A new schedule fires from when it is added, a replaced one carries on from its last occurrence
+func (s *Scheduler) AddSchedule(ctx context.Context, opts AddScheduleOptions) error {
+	if len(opts.Name) == 0 || len(opts.QName) == 0 {
+		return errors.New("AddSchedule requires Name and QName parameters")
+	}
+	if _, err := cron.ParseStandard(opts.Spec); err != nil {
+		return fmt.Errorf("AddSchedule: parse spec %q: %w", opts.Spec, err)
+	}
+	now, err := s.cl.Time(ctx).Result()
+	if err != nil {
+		return fmt.Errorf("AddSchedule: %w", err)
+	}
+	sched := Schedule{Name: opts.Name, Spec: opts.Spec, QName: opts.QName, Message: opts.Message}
+	pipe := s.cl.TxPipeline()
+	pipe.HSet(ctx, s.schedulesKey(), opts.Name, sched.String())
+	pipe.HSetNX(ctx, s.firedKey(), opts.Name, now.UnixMilli())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("AddSchedule: %w", err)
+	}
+	return nil
+}
+
+func (s *Scheduler) RemoveSchedule(ctx context.Context, opts RemoveScheduleOptions) error {
+	if len(opts.Name) == 0 {
+		return errors.New("RemoveSchedule requires a Name")
+	}
+	pipe := s.cl.TxPipeline()
+	removed := pipe.HDel(ctx, s.schedulesKey(), opts.Name)
+	pipe.HDel(ctx, s.firedKey(), opts.Name)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("RemoveSchedule: %w", err)
+	}
+	n := removed.Val()
+	if n == 0 {
+		return ScheduleNotFoundError
+	}
+	return nil
+}
+
+func (s *Scheduler) ListSchedules(ctx context.Context) ([]Schedule, error) {
+	result, err := s.cl.HGetAll(ctx, s.schedulesKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("ListSchedules: %w", err)
+	}
+	schedules := make([]Schedule, 0, len(result))
+	for name, raw := range result {
+		var sched Schedule
+		if err := json.Unmarshal([]byte(raw), &sched); err != nil {
+			return nil, fmt.Errorf("ListSchedules: unmarshal %s: %w", name, err)
+		}
+		schedules = append(schedules, sched)
+	}
+	return schedules, nil
+}
+
+// Start checks for due occurrences every interval until Quit is called.
+// Occurrences are timed against the redis server clock so that replicas agree on when a tick happened.
+func (s *Scheduler) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			now, err := s.cl.Time(ctx).Result()
+			if err != nil {
+				log.Println("scheduler: redis time:", err)
+				continue
+			}
+			if err := s.tick(ctx, now); err != nil {
+				log.Println("scheduler:", err)
+			}
+		}
+	}
+}
+
+// Quit stops Start, it returns straight away and can be called any number of times, even when Start is not running
+func (s *Scheduler) Quit() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// tick enqueues the occurrences of every schedule up to now.
+// A schedule which fails, e.g. because its queue was deleted, is logged and retried on the next tick without holding up the others
+func (s *Scheduler) tick(ctx context.Context, now time.Time) error {
+	schedules, err := s.ListSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	for _, sched := range schedules {
+		if err := s.fire(ctx, sched, now); err != nil {
+			log.Printf("scheduler: %s: %s", sched.Name, err)
+		}
+	}
+	return nil
+}
+
+// fire enqueues the occurrences of sched since it last fired up to now which have not been claimed by another replica,
+// moving the schedule on past each one that was sent
+func (s *Scheduler) fire(ctx context.Context, sched Schedule, now time.Time) error {
+	spec, err := cron.ParseStandard(sched.Spec)
+	if err != nil {
+		return err
+	}
+	since, err := s.fired(ctx, sched.Name, now)
+	if err != nil {
+		return err
+	}
+	if oldest := now.Add(-maxCatchUp); since.Before(oldest) {
+		if missed := spec.Next(since); missed.Before(oldest) {
+			log.Printf("scheduler: %s: skipping the occurrences from %s to %s", sched.Name, missed, oldest)
+		}
+		since = oldest
+		if err := s.advance(ctx, sched.Name, since); err != nil {
+			return err
+		}
+	}
+	for at := spec.Next(since); !at.After(now); at = spec.Next(at) {
+		sent, err := s.enqueue(ctx, sched, at)
+		if err != nil {
+			return fmt.Errorf("enqueue at %s: %w", at, err)
+		}
+		if !sent {
+			// another replica is still sending it, the schedule carries on from here on the next tick
+			return nil
+		}
+		if err := s.advance(ctx, sched.Name, at); err != nil {
+			return err
+		}
+	}
+	return s.advance(ctx, sched.Name, now)
+}
+
+// fired is the time sched has enqueued every occurrence up to, a schedule stored without one fires from now
+func (s *Scheduler) fired(ctx context.Context, name string, now time.Time) (time.Time, error) {
+	ms, err := s.cl.HGet(ctx, s.firedKey(), name).Int64()
+	if errors.Is(err, redis.Nil) {
+		return now, s.advance(ctx, name, now)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func (s *Scheduler) advance(ctx context.Context, name string, to time.Time) error {
+	keys := []string{s.firedKey(), name, strconv.FormatInt(to.UnixMilli(), 10)}
+	return advanceScript.Run(ctx, s.cl, keys).Err()
+}
+
+// enqueue sends the occurrence at t unless another replica claimed it, and reports whether it has been sent.
+// The claim is only marked sent after the message is, so an occurrence is never lost when a replica dies in between.
+func (s *Scheduler) enqueue(ctx context.Context, sched Schedule, at time.Time) (bool, error) {
+	key := s.occurrenceKey(sched.Name, at)
+	claimed, err := s.cl.SetNX(ctx, key, "claimed", claimTTL).Result()
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		state, err := s.cl.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			// the claim ran out since SetNX, the occurrence is retried on the next tick
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return state == "sent", nil
+	}
+	_, err = s.mq.SendMessage(ctx, q.SendMessageRequestOptions{
+		QName:     sched.QName,
+		Message:   sched.Message,
+		DeliverAt: at,
+	})
+	if err != nil {
+		// release the claim so the occurrence is retried on the next tick
+		s.cl.Del(ctx, key)
+		return false, err
+	}
+	return true, s.cl.Set(ctx, key, "sent", sentTTL).Err()
+}
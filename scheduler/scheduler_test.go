@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/ebuckley/rsmq/qtest"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newScheduler(t *testing.T, ns string) (*Scheduler, context.Context, error) {
+	ctx := context.Background()
+	s, err := New(ctx, Options{Client: qtest.RedisClient(t), NameSpace: &ns})
+	if err != nil {
+		return nil, ctx, fmt.Errorf("new scheduler: %w", err)
+	}
+	return s, ctx, nil
+}
+
+func TestTickEnqueuesOnceAcrossReplicas(t *testing.T) {
+	ns := fmt.Sprintf("scheduler-test-%d", rand.Int63())
+	first, ctx, err := newScheduler(t, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := newScheduler(t, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qName := "reminders"
+	err = first.mq.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = first.AddSchedule(ctx, AddScheduleOptions{Name: "every-minute", Spec: "* * * * *", QName: qName, Message: "tick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().Add(-3 * time.Minute).Truncate(time.Minute).Add(time.Second)
+	now := since.Add(3 * time.Minute)
+	for _, s := range []*Scheduler{first, second, first} {
+		// each replica starts from the same point, as if it read it before the others moved the schedule on
+		s.cl.HSet(ctx, s.firedKey(), "every-minute", since.UnixMilli())
+		if err := s.tick(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attrs, err := first.mq.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.TotalSent != 3 {
+		t.Fatalf("expected 3 occurrences to be enqueued exactly once but %d were sent", attrs.TotalSent)
+	}
+}
+
+func TestTickSkipsFailingSchedules(t *testing.T) {
+	s, ctx, err := newScheduler(t, fmt.Sprintf("scheduler-test-%d", rand.Int63()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	qName := "reminders"
+	if err := s.mq.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qName}); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []AddScheduleOptions{
+		{Name: "deleted-queue", Spec: "* * * * *", QName: "deleted", Message: "lost"},
+		{Name: "every-minute", Spec: "* * * * *", QName: qName, Message: "tick"},
+	} {
+		if err := s.AddSchedule(ctx, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the schedules were last checked long ago, only the last maxCatchUp of occurrences are enqueued
+	now := time.Now().Truncate(time.Minute).Add(time.Second)
+	for _, name := range []string{"deleted-queue", "every-minute"} {
+		s.cl.HSet(ctx, s.firedKey(), name, now.Add(-3*time.Hour).UnixMilli())
+	}
+	if err := s.tick(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := s.mq.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: qName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(maxCatchUp / time.Minute); attrs.TotalSent != want {
+		t.Fatalf("expected %d occurrences despite the failing schedule but %d were sent", want, attrs.TotalSent)
+	}
+	fired, err := s.fired(ctx, "deleted-queue", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(-maxCatchUp); !fired.Equal(want) {
+		t.Fatalf("expected the failing schedule to stay at its first missed occurrence after %s but it is at %s", want, fired)
+	}
+}
+
+func TestQuitWithoutStart(t *testing.T) {
+	s, ctx, err := newScheduler(t, fmt.Sprintf("scheduler-test-%d", rand.Int63()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Quit()
+	s.Quit()
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("expected Start to return once Quit was called but got %s", err)
+	}
+}
+
+func TestAddScheduleValidatesSpec(t *testing.T) {
+	s, ctx, err := newScheduler(t, fmt.Sprintf("scheduler-test-%d", rand.Int63()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddSchedule(ctx, AddScheduleOptions{Name: "bad", Spec: "not a cron spec", QName: "reminders"})
+	if err == nil {
+		t.Fatal("expected an invalid spec to be rejected")
+	}
+	err = s.RemoveSchedule(ctx, RemoveScheduleOptions{Name: "bad"})
+	if err != ScheduleNotFoundError {
+		t.Fatalf("expected ScheduleNotFoundError but got %v", err)
+	}
+}
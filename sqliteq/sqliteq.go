@@ -0,0 +1,570 @@
+package sqliteq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ebuckley/rsmq/q"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SQLiteSMQ is a durable single node q.Queue stored in a SQLite database, with the same semantics as q.RedisSMQ.
+// Every operation runs in its own transaction, so a message is never received by two consumers at once,
+// even when several processes share the database file.
+type SQLiteSMQ struct {
+	db    *sql.DB
+	clock func() time.Time
+}
+
+type Options struct {
+	// Path is the database file, which is created if it does not exist
+	Path string
+	// Clock returns the current time, defaults to time.Now
+	Clock func() time.Time
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS queues (
+	name TEXT PRIMARY KEY,
+	vt INTEGER NOT NULL,
+	delay INTEGER NOT NULL,
+	maxsize INTEGER NOT NULL,
+	totalrecv INTEGER NOT NULL DEFAULT 0,
+	totalsent INTEGER NOT NULL DEFAULT 0,
+	created TEXT NOT NULL,
+	modified TEXT NOT NULL,
+	retention INTEGER NOT NULL DEFAULT 0,
+	dlq TEXT NOT NULL DEFAULT '',
+	maxrecvrate INTEGER NOT NULL DEFAULT 0,
+	maxmsgs INTEGER NOT NULL DEFAULT 0,
+	maxbytes INTEGER NOT NULL DEFAULT 0,
+	bytes INTEGER NOT NULL DEFAULT 0,
+	paused INTEGER NOT NULL DEFAULT 0,
+	tokens REAL NOT NULL DEFAULT 0,
+	tokens_at INTEGER NOT NULL DEFAULT 0,
+	tokens_expire INTEGER NOT NULL DEFAULT 0,
+	dlqdropped INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS messages (
+	queue TEXT NOT NULL,
+	id TEXT NOT NULL,
+	body TEXT NOT NULL,
+	score INTEGER NOT NULL,
+	rc INTEGER NOT NULL DEFAULT 0,
+	fr INTEGER NOT NULL DEFAULT 0,
+	exp INTEGER NOT NULL DEFAULT 0,
+	meta TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (queue, id)
+);
+CREATE INDEX IF NOT EXISTS messages_visibility ON messages (queue, score, id);
+`
+
+var _ q.Queue = (*SQLiteSMQ)(nil)
+
+// New opens the database at Path and creates the tables if needed
+func New(ctx context.Context, opts Options) (*SQLiteSMQ, error) {
+	if len(opts.Path) == 0 {
+		return nil, errors.New("Path must be provided")
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = time.Now
+	}
+	// immediate transactions take the write lock up front, so concurrent receives wait for each other instead of failing
+	// the path is escaped as a URI, so a ? or # in it is not read as the start of the options
+	path := (&url.URL{Path: opts.Path}).EscapedPath()
+	db, err := sql.Open("sqlite3", "file:"+path+"?_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", opts.Path, err)
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.ExecContext(ctx, schema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	return &SQLiteSMQ{db: db, clock: clock}, nil
+}
+
+// queue is a row of the queues table
+type queue struct {
+	q.QueueAttributes
+	bucket q.TokenBucket
+}
+
+const queueColumns = `vt, delay, maxsize, totalrecv, totalsent, created, modified, retention, dlq, maxrecvrate,
+	maxmsgs, maxbytes, bytes, paused, tokens, tokens_at, tokens_expire, dlqdropped`
+
+// tx runs fn in a transaction, committing it when fn returns no error
+func (s *SQLiteSMQ) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func getQueue(ctx context.Context, tx *sql.Tx, name string) (*queue, error) {
+	var qu queue
+	err := tx.QueryRowContext(ctx, `SELECT `+queueColumns+` FROM queues WHERE name = ?`, name).Scan(
+		&qu.VisibilityTimeout, &qu.DelayForMessages, &qu.MaxSizeBytes, &qu.TotalReceived, &qu.TotalSent,
+		&qu.Created, &qu.Modified, &qu.MessageRetentionSeconds, &qu.DeadLetterQueue, &qu.MaxReceivesPerSecond,
+		&qu.MaxMessages, &qu.MaxBytes, &qu.CurrentBytes, &qu.Paused, &qu.bucket.Tokens, &qu.bucket.At, &qu.bucket.Expire, &qu.DeadLetterDropped)
+	if err == sql.ErrNoRows {
+		return nil, q.QueueNotFoundError
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getQueue %s: %w", name, err)
+	}
+	return &qu, nil
+}
+
+func (s *SQLiteSMQ) CreateQueue(ctx context.Context, opts q.CreateQueueRequestOptions) error {
+	now := strconv.FormatInt(s.clock().Unix(), 10)
+	// like RedisSMQ, creating an existing queue resets its attributes but keeps its messages and counters
+	_, err := s.db.ExecContext(ctx, `INSERT INTO queues (name, vt, delay, maxsize, created, modified) VALUES (?, 30, 0, 65536, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET vt = 30, delay = 0, maxsize = 65536, created = excluded.created, modified = excluded.modified`,
+		opts.QName, now, now)
+	if err != nil {
+		return fmt.Errorf("CreateQueue: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteSMQ) ListQueues(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM queues ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("ListQueues: %w", err)
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("ListQueues: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *SQLiteSMQ) DeleteQueue(ctx context.Context, options q.DeleteQueueRequestOptions) error {
+	if len(options.QName) == 0 {
+		return errors.New("QName is empty")
+	}
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE queue = ?`, options.QName); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM queues WHERE name = ?`, options.QName)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteQueue: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteSMQ) GetQueueAttributes(ctx context.Context, opts q.GetQueueAttributesOptions) (*q.QueueAttributes, error) {
+	var attrs *q.QueueAttributes
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		attrs, err = attributes(ctx, tx, opts.QName, s.clock().UnixMilli())
+		return err
+	})
+	return attrs, err
+}
+
+func attributes(ctx context.Context, tx *sql.Tx, name string, now int64) (*q.QueueAttributes, error) {
+	qu, err := getQueue(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+	attrs := qu.QueueAttributes
+	// like RedisSMQ, messages visible from this millisecond are still counted as hidden
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(CASE WHEN score >= ? THEN 1 END) FROM messages WHERE queue = ?`, now, name).
+		Scan(&attrs.CurrentN, &attrs.HiddenMessages)
+	if err != nil {
+		return nil, fmt.Errorf("GetQueueAttributes: %w", err)
+	}
+	return &attrs, nil
+}
+
+func (s *SQLiteSMQ) SetQueueAttributes(ctx context.Context, options q.SetAttributesOptions) (*q.QueueAttributes, error) {
+	if len(options.QName) == 0 {
+		return nil, errors.New("QName must be provided")
+	}
+	if options.DelayForMessages == nil && options.VisibilityTimeout == nil && options.Maxsize == nil &&
+		options.MessageRetentionSeconds == nil && options.DeadLetterQueue == nil && options.MaxReceivesPerSecond == nil &&
+		options.MaxMessages == nil && options.MaxBytes == nil {
+		return nil, errors.New("must provide a new value for at least one queue attribute")
+	}
+	if options.DeadLetterQueue != nil && *options.DeadLetterQueue == options.QName {
+		return nil, errors.New("DeadLetterQueue must be a different queue")
+	}
+
+	now := s.clock()
+	var attrs *q.QueueAttributes
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := getQueue(ctx, tx, options.QName); err != nil {
+			return err
+		}
+		set := func(column string, value interface{}) error {
+			_, err := tx.ExecContext(ctx, `UPDATE queues SET `+column+` = ? WHERE name = ?`, value, options.QName)
+			return err
+		}
+		if err := set("modified", strconv.FormatInt(now.Unix(), 10)); err != nil {
+			return err
+		}
+		columns := []struct {
+			name  string
+			value interface{}
+			isSet bool
+		}{
+			{"delay", options.DelayForMessages, options.DelayForMessages != nil},
+			{"maxsize", options.Maxsize, options.Maxsize != nil},
+			{"vt", options.VisibilityTimeout, options.VisibilityTimeout != nil},
+			{"retention", options.MessageRetentionSeconds, options.MessageRetentionSeconds != nil},
+			{"dlq", options.DeadLetterQueue, options.DeadLetterQueue != nil},
+			{"maxrecvrate", options.MaxReceivesPerSecond, options.MaxReceivesPerSecond != nil},
+			{"maxmsgs", options.MaxMessages, options.MaxMessages != nil},
+			{"maxbytes", options.MaxBytes, options.MaxBytes != nil},
+		}
+		for _, c := range columns {
+			if !c.isSet {
+				continue
+			}
+			if err := set(c.name, c.value); err != nil {
+				return err
+			}
+		}
+		var err error
+		attrs, err = attributes(ctx, tx, options.QName, now.UnixMilli())
+		return err
+	})
+	if err != nil && err != q.QueueNotFoundError {
+		return nil, fmt.Errorf("SetQueueAttributes: %w", err)
+	}
+	return attrs, err
+}
+
+// PauseQueue stops ReceiveMessage and PopMessage returning messages from the queue until ResumeQueue is called
+func (s *SQLiteSMQ) PauseQueue(ctx context.Context, options q.PauseQueueOptions) error {
+	return s.setPaused(ctx, options.QName, true)
+}
+
+// ResumeQueue lets a paused queue be received from again
+func (s *SQLiteSMQ) ResumeQueue(ctx context.Context, options q.ResumeQueueOptions) error {
+	return s.setPaused(ctx, options.QName, false)
+}
+
+func (s *SQLiteSMQ) setPaused(ctx context.Context, qname string, paused bool) error {
+	if len(qname) == 0 {
+		return errors.New("QName is empty")
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE queues SET paused = ?, modified = ? WHERE name = ?`,
+		paused, strconv.FormatInt(s.clock().Unix(), 10), qname)
+	if err != nil {
+		return fmt.Errorf("setPaused: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return q.QueueNotFoundError
+	}
+	return nil
+}
+
+func (s *SQLiteSMQ) SendMessage(ctx context.Context, opts q.SendMessageRequestOptions) (string, error) {
+	now := s.clock()
+	id := q.MakeMessageID(now)
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		qu, err := getQueue(ctx, tx, opts.QName)
+		if err != nil {
+			return err
+		}
+		if int64(len(opts.Message)) > qu.MaxSizeBytes {
+			return errors.New("Message is larger than allowed max size: " + strconv.FormatInt(qu.MaxSizeBytes, 10))
+		}
+		full, err := isFull(ctx, tx, opts.QName, qu, len(opts.Message))
+		if err != nil {
+			return err
+		}
+		if full {
+			return q.QueueFullError
+		}
+		// the queue delay is in seconds, as it is for RedisSMQ
+		delay := qu.DelayForMessages
+		if opts.Delay > 0 {
+			delay = opts.Delay
+		}
+		score := now.Add(time.Duration(delay) * time.Second).UnixMilli()
+		if !opts.DeliverAt.IsZero() {
+			score = opts.DeliverAt.UnixMilli()
+			if opts.DeliverAt.Before(now) {
+				score = now.UnixMilli()
+			}
+		}
+		var meta string
+		if len(opts.Metadata) > 0 {
+			b, err := json.Marshal(opts.Metadata)
+			if err != nil {
+				return fmt.Errorf("marshal metadata: %w", err)
+			}
+			meta = string(b)
+		}
+		return add(ctx, tx, opts.QName, message{
+			id:    id,
+			body:  opts.Message,
+			score: score,
+			exp:   q.ExpiresUnix(now, qu.MessageRetentionSeconds, opts.TTL),
+			meta:  meta,
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *SQLiteSMQ) ReceiveMessage(ctx context.Context, opts q.ReceiveMessageOptions) (*q.Message, error) {
+	now := s.clock()
+	var received *q.Message
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		qu, err := getQueue(ctx, tx, opts.QName)
+		if err != nil {
+			return fmt.Errorf("recieve message: %w", err)
+		}
+		vt := qu.VisibilityTimeout
+		if opts.VisibilityTimeout != nil {
+			vt = *opts.VisibilityTimeout
+		}
+		msg, err := next(ctx, tx, opts.QName, qu, now.UnixMilli())
+		if msg == nil || err != nil {
+			return err
+		}
+		deadline := now.Add(time.Duration(vt) * time.Second)
+		msg.score = deadline.UnixMilli()
+		msg.rc++
+		if msg.rc == 1 {
+			msg.fr = now.UnixMilli()
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET score = ?, rc = ?, fr = ? WHERE queue = ? AND id = ?`,
+			msg.score, msg.rc, msg.fr, opts.QName, msg.id)
+		if err != nil {
+			return err
+		}
+		received, err = msg.toMessage(deadline)
+		return err
+	})
+	return received, err
+}
+
+func (s *SQLiteSMQ) PopMessage(ctx context.Context, options q.PopMessageOptions) (*q.Message, error) {
+	if len(options.QName) == 0 {
+		return nil, errors.New("popMessage validation failed. Expected options.QName to be set")
+	}
+	now := s.clock()
+	var popped *q.Message
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		qu, err := getQueue(ctx, tx, options.QName)
+		if err != nil {
+			return err
+		}
+		msg, err := next(ctx, tx, options.QName, qu, now.UnixMilli())
+		if msg == nil || err != nil {
+			return err
+		}
+		msg.rc++
+		if msg.rc == 1 {
+			msg.fr = now.UnixMilli()
+		}
+		if err := remove(ctx, tx, options.QName, msg.id); err != nil {
+			return err
+		}
+		popped, err = msg.toMessage(now.Add(time.Duration(qu.VisibilityTimeout) * time.Second))
+		return err
+	})
+	return popped, err
+}
+
+func (s *SQLiteSMQ) DeleteMessage(ctx context.Context, options q.DeleteMessageRequest) error {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return errors.New("options.QNAME or options.ID was empty but it should not be empty")
+	}
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		return remove(ctx, tx, options.QName, options.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("deleteMessage: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteSMQ) ChangeMessageVisibility(ctx context.Context, options q.ChangeMessageVisibilityOptions) (bool, error) {
+	if len(options.QName) == 0 || len(options.ID) == 0 {
+		return false, fmt.Errorf("ChangeMessageVisibility requires QName and ID parameters")
+	}
+	var changed bool
+	err := s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := getQueue(ctx, tx, options.QName); err != nil {
+			return fmt.Errorf("getQueue: %w", err)
+		}
+		score := s.clock().Add(time.Duration(options.VisibilityTimeout) * time.Second).UnixMilli()
+		res, err := tx.ExecContext(ctx, `UPDATE messages SET score = ? WHERE queue = ? AND id = ?`, score, options.QName, options.ID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		changed = n == 1
+		return err
+	})
+	return changed, err
+}
+
+func (s *SQLiteSMQ) Close() error {
+	return s.db.Close()
+}
+
+type message struct {
+	id    string
+	body  string
+	score int64
+	rc    int64
+	fr    int64
+	exp   int64
+	meta  string
+}
+
+// next applies the pause and rate limit of the queue and returns the first visible message which has not expired,
+// moving expired messages to the dead letter queue on the way. It mirrors the receive script of RedisSMQ.
+func next(ctx context.Context, tx *sql.Tx, name string, qu *queue, now int64) (*message, error) {
+	if qu.Paused {
+		return nil, nil
+	}
+	tokens, err := qu.bucket.Available(qu.MaxReceivesPerSecond, now)
+	if err != nil {
+		return nil, err
+	}
+	for expires := 0; ; expires++ {
+		var msg message
+		err := tx.QueryRowContext(ctx, `SELECT id, body, score, rc, fr, exp, meta FROM messages
+			WHERE queue = ? AND score <= ? ORDER BY score, id LIMIT 1`, name, now).
+			Scan(&msg.id, &msg.body, &msg.score, &msg.rc, &msg.fr, &msg.exp, &msg.meta)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg.exp > 0 && msg.exp <= now {
+			if expires == q.MaxExpiresPerReceive {
+				return nil, nil
+			}
+			if err := expire(ctx, tx, name, qu.DeadLetterQueue, msg, now); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE queues SET totalrecv = totalrecv + 1 WHERE name = ?`, name)
+		if err != nil {
+			return nil, err
+		}
+		if qu.MaxReceivesPerSecond > 0 {
+			qu.bucket.Take(tokens, now)
+			_, err = tx.ExecContext(ctx, `UPDATE queues SET tokens = ?, tokens_at = ?, tokens_expire = ? WHERE name = ?`,
+				qu.bucket.Tokens, qu.bucket.At, qu.bucket.Expire, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &msg, nil
+	}
+}
+
+func expire(ctx context.Context, tx *sql.Tx, name string, dlq string, msg message, now int64) error {
+	if err := remove(ctx, tx, name, msg.id); err != nil {
+		return err
+	}
+	if dlq == "" {
+		return nil
+	}
+	dq, err := getQueue(ctx, tx, dlq)
+	if err == q.QueueNotFoundError {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	full, err := isFull(ctx, tx, dlq, dq, len(msg.body))
+	if err != nil {
+		return err
+	}
+	if full {
+		_, err := tx.ExecContext(ctx, `UPDATE queues SET dlqdropped = dlqdropped + 1 WHERE name = ?`, name)
+		return err
+	}
+	msg.score, msg.exp = now, 0
+	return add(ctx, tx, dlq, msg)
+}
+
+func isFull(ctx context.Context, tx *sql.Tx, name string, qu *queue, size int) (bool, error) {
+	if qu.MaxMessages > 0 {
+		var n int64
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages WHERE queue = ?`, name).Scan(&n)
+		if err != nil {
+			return false, err
+		}
+		if n >= qu.MaxMessages {
+			return true, nil
+		}
+	}
+	return qu.MaxBytes > 0 && qu.CurrentBytes+int64(size) > qu.MaxBytes, nil
+}
+
+func add(ctx context.Context, tx *sql.Tx, name string, msg message) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO messages (queue, id, body, score, rc, fr, exp, meta) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, msg.id, msg.body, msg.score, msg.rc, msg.fr, msg.exp, msg.meta)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE queues SET bytes = bytes + ?, totalsent = totalsent + 1 WHERE name = ?`, len(msg.body), name)
+	return err
+}
+
+func remove(ctx context.Context, tx *sql.Tx, name string, id string) error {
+	var size int64
+	err := tx.QueryRowContext(ctx, `DELETE FROM messages WHERE queue = ? AND id = ? RETURNING length(CAST(body AS BLOB))`, name, id).Scan(&size)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE queues SET bytes = MAX(bytes - ?, 0) WHERE name = ?`, size, name)
+	return err
+}
+
+func (msg *message) toMessage(deadline time.Time) (*q.Message, error) {
+	var meta map[string]string
+	if len(msg.meta) > 0 {
+		if err := json.Unmarshal([]byte(msg.meta), &meta); err != nil {
+			return nil, fmt.Errorf("could not parse the metadata: %w", err)
+		}
+	}
+	return &q.Message{
+		ID:       msg.id,
+		Message:  msg.body,
+		RC:       msg.rc,
+		FR:       time.UnixMilli(msg.fr),
+		Sent:     q.SentFromID(msg.id),
+		Deadline: &deadline,
+		Metadata: meta,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package sqliteq
+
+import (
+	"context"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/ebuckley/rsmq/qtest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queues.sqlite")
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	s, err := New(ctx, Options{Path: path, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.SendMessage(ctx, q.SendMessageRequestOptions{QName: "orders", Message: "durable", Metadata: map[string]string{"k": "v"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || first.ID != id || first.RC != 1 || first.Metadata["k"] != "v" {
+		t.Fatalf("expected to receive %s but got %s", id, first)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is still in flight after reopening, and becomes visible once the visibility timeout passes
+	s, err = New(ctx, Options{Path: path, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	msg, err := s.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != nil {
+		t.Fatalf("expected the message to still be in flight but got %s", msg)
+	}
+	now = now.Add(31 * time.Second)
+	msg, err = s.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg == nil || msg.ID != id || msg.RC != 2 || !msg.FR.Equal(first.FR) {
+		t.Fatalf("expected to receive %s a second time but got %s", id, msg)
+	}
+	attrs, err := s.GetQueueAttributes(ctx, q.GetQueueAttributesOptions{QName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.TotalSent != 1 || attrs.TotalReceived != 2 || attrs.CurrentN != 1 || attrs.HiddenMessages != 1 {
+		t.Fatalf("expected the counters to survive reopening but got %s", attrs)
+	}
+}
+
+func TestPathWithURICharacters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queues?v=1#50% off.sqlite")
+	s, err := New(ctx, Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: "jobs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the database to be created at %s: %s", path, err)
+	}
+}
+
+func TestConcurrentReceive(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(ctx, Options{Path: filepath.Join(t.TempDir(), "queues.sqlite")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: "jobs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		_, err := s.SendMessage(ctx, q.SendMessageRequestOptions{QName: "jobs", Message: "job"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	var wg sync.WaitGroup
+	for w := 0; w < 5; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := s.ReceiveMessage(ctx, q.ReceiveMessageOptions{QName: "jobs"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if msg == nil {
+					return
+				}
+				mu.Lock()
+				received[msg.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(received) != n {
+		t.Fatalf("expected %d messages to be received but got %d", n, len(received))
+	}
+	for id, count := range received {
+		if count != 1 {
+			t.Fatalf("expected %s to be received once but it was received %d times", id, count)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	qtest.Run(t, func(t *testing.T) qtest.Backend {
+		clock := qtest.NewClock(time.Now())
+		s, err := New(context.Background(), Options{Path: filepath.Join(t.TempDir(), "queues.sqlite"), Clock: clock.Now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return qtest.Backend{Queue: s, Now: clock.Now, Wait: clock.Advance}
+	})
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"github.com/ebuckley/rsmq/q"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
 // Worker is an experimental framework built on top of RSMQ that is modelled after the nodejs rsmq-worker project
 type Worker struct {
-	cl      *q.RedisSMQ
+	cl      q.Queue
 	work    chan *q.Message
 	quit    chan bool
 	ctx     context.Context
@@ -23,7 +25,12 @@ type Handler interface {
 	DeadlinePassed(ctx context.Context, msg *q.Message) error
 }
 
-func New(ctx context.Context, cl *q.RedisSMQ, qName string, handler Handler) *Worker {
+// processTracer is implemented by queues which carry trace context on their messages, such as q.RedisSMQ
+type processTracer interface {
+	StartProcessSpan(ctx context.Context, qname string, msg *q.Message) (context.Context, trace.Span)
+}
+
+func New(ctx context.Context, cl q.Queue, qName string, handler Handler) *Worker {
 	work := make(chan *q.Message, 0)
 	quit := make(chan bool, 0)
 	_ = cl.CreateQueue(ctx, q.CreateQueueRequestOptions{QName: qName})
@@ -39,6 +46,11 @@ func (w *Worker) Start() {
 			message, err := w.cl.ReceiveMessage(w.ctx, q.ReceiveMessageOptions{
 				QName: w.qName,
 			})
+			var rateLimited *q.RateLimitError
+			if errors.As(err, &rateLimited) {
+				time.Sleep(rateLimited.RetryAfter)
+				continue
+			}
 			if err != nil {
 				return
 			}
@@ -58,7 +70,13 @@ func (w *Worker) Start() {
 					return
 				case msg := <-w.work:
 					iCtx, cancel := context.WithDeadline(ctx, *msg.Deadline)
+					iCtx, span := w.startProcessSpan(iCtx, msg)
 					ok, err := w.handler.Message(iCtx, msg)
+					if err != nil {
+						span.RecordError(err)
+						span.SetStatus(codes.Error, err.Error())
+					}
+					span.End()
 					if errors.Is(err, context.DeadlineExceeded) {
 						err := w.handler.DeadlinePassed(ctx, msg)
 						if err != nil {
@@ -97,6 +115,13 @@ func (w *Worker) Start() {
 	<-w.quit
 }
 
+func (w *Worker) startProcessSpan(ctx context.Context, msg *q.Message) (context.Context, trace.Span) {
+	if tracer, ok := w.cl.(processTracer); ok {
+		return tracer.StartProcessSpan(ctx, w.qName, msg)
+	}
+	return trace.NewNoopTracerProvider().Tracer("").Start(ctx, w.qName+" process")
+}
+
 func (w *Worker) Quit() error {
 	err := w.cl.Close()
 	if err != nil {
@@ -0,0 +1,135 @@
+package worker
+
+import (
+	"context"
+	"github.com/ebuckley/rsmq/q"
+	"github.com/ebuckley/rsmq/qtest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+type spanHandler struct {
+	spans chan trace.SpanContext
+}
+
+func (h spanHandler) Message(ctx context.Context, msg *q.Message) (bool, error) {
+	h.spans <- trace.SpanContextFromContext(ctx)
+	return true, nil
+}
+
+func (h spanHandler) Error(ctx context.Context, err error, msg *q.Message) error {
+	return nil
+}
+
+func (h spanHandler) DeadlinePassed(ctx context.Context, msg *q.Message) error {
+	return nil
+}
+
+func TestWorkerProcessSpan(t *testing.T) {
+	ctx := context.Background()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	mq, err := q.New(ctx, q.Options{Client: qtest.RedisClient(t), TracerProvider: tp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qName := "TestWorkerProcessSpan" + time.Now().Format("150405.000")
+
+	h := spanHandler{spans: make(chan trace.SpanContext, 1)}
+	w := New(ctx, mq, qName, h)
+	_, err = mq.SendMessage(ctx, q.SendMessageRequestOptions{QName: qName, Message: "traced work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Start()
+
+	var handled trace.SpanContext
+	select {
+	case handled = <-h.spans:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler did not receive the message")
+	}
+	if !handled.IsValid() {
+		t.Fatal("expected the handler context to carry the process span")
+	}
+
+	// the span ends after the handler returns, so wait for it to be exported
+	var send, process *tracetest.SpanStub
+	for deadline := time.Now().Add(5 * time.Second); process == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		spans := exporter.GetSpans()
+		for i := range spans {
+			switch spans[i].SpanKind {
+			case trace.SpanKindProducer:
+				send = &spans[i]
+			case trace.SpanKindConsumer:
+				process = &spans[i]
+			}
+		}
+	}
+	_ = mq.DeleteQueue(ctx, q.DeleteQueueRequestOptions{QName: qName})
+	_ = w.Quit()
+
+	if send == nil || process == nil {
+		t.Fatal("expected a send and a process span to be exported")
+	}
+	if process.SpanContext.SpanID() != handled.SpanID() {
+		t.Fatal("expected the handler to run inside the process span")
+	}
+	if len(process.Links) != 1 || process.Links[0].SpanContext.TraceID() != send.SpanContext.TraceID() {
+		t.Fatal("expected the process span to be linked to the send span")
+	}
+}
+
+// stubQueue implements just the q.Queue methods the worker uses
+type stubQueue struct {
+	q.Queue
+	messages chan *q.Message
+	deleted  chan string
+}
+
+func (s *stubQueue) CreateQueue(ctx context.Context, opts q.CreateQueueRequestOptions) error {
+	return nil
+}
+
+func (s *stubQueue) ReceiveMessage(ctx context.Context, opts q.ReceiveMessageOptions) (*q.Message, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (s *stubQueue) DeleteMessage(ctx context.Context, options q.DeleteMessageRequest) error {
+	s.deleted <- options.ID
+	return nil
+}
+
+func (s *stubQueue) Close() error {
+	return nil
+}
+
+func TestWorkerQueueInterface(t *testing.T) {
+	ctx := context.Background()
+	deadline := time.Now().Add(time.Minute)
+	stub := &stubQueue{messages: make(chan *q.Message, 1), deleted: make(chan string, 1)}
+	stub.messages <- &q.Message{ID: "stubbed", Message: "work", Deadline: &deadline}
+
+	h := spanHandler{spans: make(chan trace.SpanContext, 1)}
+	w := New(ctx, stub, "TestWorkerQueueInterface", h)
+	go w.Start()
+
+	select {
+	case id := <-stub.deleted:
+		if id != "stubbed" {
+			t.Fatalf("expected the handled message to be deleted but got %s", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker did not delete the handled message")
+	}
+	_ = w.Quit()
+}